@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Returns the token file of a Gmail account: the -token file itself for the
+// default account, or the same name with "-<account>" appended otherwise,
+// e.g. "token-work.json"
+func accountTokenPath(tokenPath string, account string) string {
+	if account == "" {
+		return tokenPath
+	}
+
+	ext := filepath.Ext(tokenPath)
+	return strings.TrimSuffix(tokenPath, ext) + "-" + account + ext
+}
+
+// Authenticates every Gmail account the configuration scrapes, keyed by
+// account name. The default account ("") reuses its already loaded client.
+func loadAccountClients(credentialsPath string, tokenPath string, configs []SourceConfig, defaultClient *http.Client) map[string]*http.Client {
+	clients := map[string]*http.Client{"": defaultClient}
+
+	for _, config := range configs {
+		if _, ok := clients[config.Account]; ok {
+			continue
+		}
+
+		clients[config.Account] = loadAccountClient(credentialsPath, tokenPath, config.Account)
+	}
+
+	return clients
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Fetches and decodes a message attachment, into a new file in dir when
+// set or in memory otherwise. Attachments in cacheDir, when set, aren't
+// fetched again. Returns the contents or file path, and the decoded size
+// in bytes.
+func fetchAttachment(ctx context.Context, messages messageLister, messageId string, attachmentPart *gmail.MessagePart, dir string, cacheDir string) ([]byte, string, int, error) {
+	data, err := getAttachmentData(ctx, messages, messageId, attachmentPart, cacheDir)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("unable to retrieve attachment: %w", err)
+	}
+
+	var contents []byte
+	var path string
+	var size int
+	if dir != "" {
+		path, size, err = decodeAttachmentToFile(dir, data)
+	} else {
+		contents, err = decodeBase64(data)
+		size = len(contents)
+	}
+
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("unable to decode attachment: %w", err)
+	}
+
+	return contents, path, size, nil
+}
+
+// Picks the base64 alphabet and padding data is encoded with. Gmail
+// documents base64url, but some messages come in the standard alphabet or
+// without padding.
+func base64EncodingOf(data string) *base64.Encoding {
+	std := strings.ContainsAny(data, "+/")
+	padded := len(data)%4 == 0
+
+	switch {
+	case std && padded:
+		return base64.StdEncoding
+	case std:
+		return base64.RawStdEncoding
+	case padded:
+		return base64.URLEncoding
+	default:
+		return base64.RawURLEncoding
+	}
+}
+
+// Decodes base64 data in either alphabet, with or without padding
+func decodeBase64(data string) ([]byte, error) {
+	return base64EncodingOf(data).DecodeString(data)
+}
+
+// Decodes a base64 encoded attachment straight into a new file in dir,
+// without holding the decoded contents in memory. Returns the file path and
+// the decoded size in bytes.
+func decodeAttachmentToFile(dir string, data string) (string, int, error) {
+	f, err := os.CreateTemp(dir, "attachment-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	decoder := base64.NewDecoder(base64EncodingOf(data), strings.NewReader(data))
+	size, err := io.Copy(f, decoder)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+
+	return f.Name(), int(size), nil
+}
+
+// In-memory attachment contents, seekable so uploads can be retried and signed
+type memoryAttachment struct {
+	*bytes.Reader
+}
+
+func (memoryAttachment) Close() error {
+	return nil
+}
+
+// Opens the contents of an attachment kept either in memory or on disk
+func openAttachment(contents []byte, path string) (io.ReadSeekCloser, error) {
+	if path != "" {
+		return os.Open(path)
+	}
+
+	return memoryAttachment{bytes.NewReader(contents)}, nil
+}
+
+// Opens the invoice file contents for reading
+func (i Invoice) Open() (io.ReadSeekCloser, error) {
+	return openAttachment(i.FileContents, i.FilePath)
+}
+
+// Returns the file name of a message part that is an attachment, empty
+// otherwise. Parts without a Filename, like pdfs embedded inline and only
+// referenced by their Content-ID, count when they're declared as an
+// attachment or are pdfs, and get their name from the Content-Disposition
+// or Content-Type parameters, or else from the Content-ID.
+func attachmentFilename(part *gmail.MessagePart) string {
+	if part.Body == nil || part.Body.AttachmentId == "" {
+		return ""
+	}
+	if part.Filename != "" {
+		return part.Filename
+	}
+
+	var disposition, contentId, name string
+	for _, header := range part.Headers {
+		switch strings.ToLower(header.Name) {
+		case "content-disposition":
+			value, params, err := mime.ParseMediaType(header.Value)
+			if err == nil {
+				disposition = value
+				name = cmp.Or(name, params["filename"])
+			}
+		case "content-type":
+			_, params, err := mime.ParseMediaType(header.Value)
+			if err == nil {
+				name = cmp.Or(params["name"], name)
+			}
+		case "content-id":
+			contentId = strings.Trim(strings.TrimSpace(header.Value), "<>")
+		}
+	}
+
+	if disposition != "attachment" && part.MimeType != "application/pdf" {
+		return ""
+	}
+	if name != "" {
+		return filepath.Base(name)
+	}
+
+	ext := ".pdf"
+	if part.MimeType != "application/pdf" {
+		exts, err := mime.ExtensionsByType(part.MimeType)
+		if err == nil && len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	// Content-IDs look like "invoice123@provider.example"
+	base, _, _ := strings.Cut(contentId, "@")
+	return cmp.Or(filepath.Base(base), "attachment") + ext
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"os/exec"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Name of the stand-in attachment of an email body saved as pdf
+const bodyPDFName = "body.pdf"
+
+// Renders an email body to a pdf, to save it as the invoice of emails
+// without an attachment. Plain text bodies are rendered preformatted.
+// Uses wkhtmltopdf cli tool.
+func renderBodyPDF(bodyPart *gmail.MessagePart) ([]byte, error) {
+	decodedBody, err := decodeBase64(bodyPart.Body.Data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode body: %w", err)
+	}
+
+	page := string(decodedBody)
+	if bodyPart.MimeType == "text/plain" {
+		page = "<meta charset=\"utf-8\"><pre>" + html.EscapeString(page) + "</pre>"
+	}
+
+	cmd := exec.Command("wkhtmltopdf", "--quiet", "-", "-")
+	cmd.Stdin = strings.NewReader(page)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
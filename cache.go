@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Directory attachments are cached in unless -cache-dir is given
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ".attachment_cache"
+	}
+	return filepath.Join(dir, "email-invoice-manager")
+}
+
+// Path of the cached attachment of a message part. Attachment IDs change
+// every time a message is fetched, so parts are identified by their part
+// ID, which doesn't.
+func attachmentCachePath(cacheDir string, messageId string, partId string) string {
+	return filepath.Join(cacheDir, messageId+"-"+partId)
+}
+
+// Gets the base64url encoded contents of a message attachment, from
+// cacheDir when it was fetched before or from Gmail otherwise, caching it.
+// Nothing is cached when cacheDir is empty.
+func getAttachmentData(ctx context.Context, messages messageLister, messageId string, attachmentPart *gmail.MessagePart, cacheDir string) (string, error) {
+	path := attachmentCachePath(cacheDir, messageId, attachmentPart.PartId)
+
+	if cacheDir != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			slog.Debug("Attachment read from cache", "message", messageId, "path", path)
+			return string(data), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Unable to read cached attachment", "path", path, "error", err)
+		}
+	}
+
+	var attachment *gmail.MessagePartBody
+	err := withRetry(ctx, func() (err error) {
+		attachment, err = messages.GetAttachment(ctx, messageId, attachmentPart.Body.AttachmentId)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if cacheDir != "" {
+		err = os.MkdirAll(cacheDir, 0700)
+		if err == nil {
+			err = writeFileAtomic(path, []byte(attachment.Data), 0600)
+		}
+		// The attachment was fetched, so the run goes on without caching it
+		if err != nil {
+			slog.Warn("Unable to cache attachment", "path", path, "error", err)
+		}
+	}
+
+	return attachment.Data, nil
+}
+
+// Removes every cached attachment
+func clearAttachmentCache(cacheDir string) error {
+	if cacheDir == "" {
+		return nil
+	}
+
+	err := os.RemoveAll(cacheDir)
+	if err != nil {
+		return fmt.Errorf("unable to remove %s: %w", cacheDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Number of months between two invoices of the given cadence
+func cadenceMonths(cadence string) (int, error) {
+	switch cadence {
+	case "", "monthly":
+		return 1, nil
+	case "quarterly":
+		return 3, nil
+	case "annual":
+		return 12, nil
+	default:
+		return 0, fmt.Errorf("unknown cadence %q", cadence)
+	}
+}
+
+// Parses the month the source's invoices are counted from, January by default
+func (s Source) cadenceAnchor() (time.Time, error) {
+	if s.CadenceAnchor == "" {
+		return time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC), nil
+	}
+
+	return time.Parse("2006-01", s.CadenceAnchor)
+}
+
+// Whether an invoice of the source is expected in the given month, i.e.
+// the month is a whole number of cadence periods away from the anchor
+func (s Source) isBillingMonth(month time.Time) (bool, error) {
+	period, err := cadenceMonths(s.Cadence)
+	if err != nil {
+		return false, err
+	}
+
+	anchor, err := s.cadenceAnchor()
+	if err != nil {
+		return false, err
+	}
+
+	months := (month.Year()-anchor.Year())*12 + int(month.Month()) - int(anchor.Month())
+
+	return ((months%period)+period)%period == 0, nil
+}
+
+// Returns the first day of the scrape window for a billing month, which
+// covers the whole cadence period ending in that month so late or early
+// invoices are still found
+func (s Source) windowStart(month time.Time) time.Time {
+	period, err := cadenceMonths(s.Cadence)
+	if err != nil {
+		return month
+	}
+
+	return month.AddDate(0, 1-period, 0)
+}
+
+// Returns the time range emails of a billing month are searched in, from
+// midnight at windowStart to midnight at the start of the next month, both
+// in loc so emails are put in the month they arrived in the user's timezone
+func (s Source) scrapeWindow(month time.Time, loc *time.Location) (time.Time, time.Time) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	windowStart := s.windowStart(month)
+	start := time.Date(windowStart.Year(), windowStart.Month(), 1, 0, 0, 0, 0, loc)
+	end := time.Date(month.Year(), month.Month()+1, 1, 0, 0, 0, 0, loc)
+
+	return start, end
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// Checks that every configured DriveDestination exists, is a folder and
+// can be written to with the current token
+func checkDriveFolders(options Options) {
+	configs := readConfiguration(options.ConfigPath)
+	resolveDriveDestinations(configs)
+	err := validateDriveDestinations(configs)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	client := loadAuthenticatedGoogleClient(options.CredentialsPath, options.TokenPath)
+	printDriveFolderChecks(context.Background(), client, configs)
+}
+
+// Checks the whole configuration before a run: that it's valid, that every
+// DriveDestination is a writable folder and whether the Gmail search of
+// every source finds messages this month
+func checkConfiguration(options Options) {
+	ctx := context.Background()
+
+	configs := readConfiguration(options.ConfigPath)
+	resolveDriveDestinations(configs)
+	err := validateConfig(configs)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	fmt.Println("Configuration is valid")
+
+	client := loadAuthenticatedGoogleClient(options.CredentialsPath, options.TokenPath)
+	accountClients := loadAccountClients(options.CredentialsPath, options.TokenPath, configs, client)
+
+	fmt.Println("\nDrive folders:")
+	printDriveFolderChecks(ctx, client, configs)
+
+	month, _ := parseMonth("now")
+	fmt.Printf("\nGmail messages in %s:\n", historyKey(month))
+	printSourceMessageChecks(ctx, accountClients, configs, month, options.Timezone)
+}
+
+// Prints, for every group, whether its DriveDestination is a folder the
+// account can write to
+func printDriveFolderChecks(ctx context.Context, client *http.Client, configs []SourceConfig) {
+	driveService, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		log.Fatalf("Unable to retrieve Drive client: %v", err)
+	}
+
+	for _, config := range configs {
+		folder, err := driveService.Files.Get(config.DriveDestination).
+			Fields("id, name, mimeType, capabilities(canAddChildren)").
+			SupportsAllDrives(config.SharedDrive).
+			Do()
+
+		switch {
+		case isDrivePermissionError(err):
+			fmt.Printf("%s: %s\n", config.Name, drivePermissionMessage(config.DriveDestination))
+		case err != nil:
+			log.Fatalf("Unable to get folder: %v", err)
+		case folder.MimeType != "application/vnd.google-apps.folder":
+			fmt.Printf("%s: %s (%s) is not a folder\n", config.Name, folder.Name, folder.Id)
+		case folder.Capabilities == nil || !folder.Capabilities.CanAddChildren:
+			fmt.Printf("%s: %s\n", config.Name, drivePermissionMessage(config.DriveDestination))
+		default:
+			fmt.Printf("%s: %s (%s) is writable\n", config.Name, folder.Name, folder.Id)
+		}
+	}
+}
+
+// Prints, for every source, how many messages its Gmail search finds in
+// the month, without fetching them
+func printSourceMessageChecks(ctx context.Context, accountClients map[string]*http.Client, configs []SourceConfig, month time.Time, loc *time.Location) {
+	for _, config := range configs {
+		srv, err := gmail.NewService(ctx, option.WithHTTPClient(accountClients[config.Account]))
+		if err != nil {
+			log.Fatalf("Unable to retrieve Gmail client: %v", err)
+		}
+
+		for _, source := range config.Sources {
+			windowStart, windowEnd := source.scrapeWindow(month, loc)
+			query := gmailQuery(source, gmailTime(windowStart), gmailTime(windowEnd))
+
+			msgs, err := listMessages(ctx, gmailMessages{srv: srv}, query)
+
+			matching := "from " + strings.Join(source.From, ", ")
+			if source.QueryOverride != "" {
+				matching = fmt.Sprintf("matching %q", source.QueryOverride)
+			}
+
+			switch {
+			case err != nil:
+				fmt.Printf("%s / %s: unable to search messages: %v\n", config.Name, source.BillName, err)
+			case len(msgs) == 0:
+				fmt.Printf("%s / %s: no messages %s\n", config.Name, source.BillName, matching)
+			default:
+				fmt.Printf("%s / %s: %d messages %s\n", config.Name, source.BillName, len(msgs), matching)
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Checks the whole configuration before any network work, returning every
+// problem found instead of stopping at the first one. DriveDestinations are
+// expected to be resolved from the environment already.
+func validateConfig(configs []SourceConfig) error {
+	return errors.Join(validateDriveDestinations(configs), validateSources(configs))
+}
+
+// Checks that every group has a Drive folder to upload to
+func validateDriveDestinations(configs []SourceConfig) error {
+	var problems []error
+
+	for configIdx, config := range configs {
+		if config.DriveDestination == "" {
+			problems = append(problems, fmt.Errorf(
+				"group %d (%s): DriveDestination is empty and %s is not set",
+				configIdx, config.Name, driveDestinationEnv(config.Name),
+			))
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// Checks the settings of every group and source that don't depend on where
+// invoices are stored
+func validateSources(configs []SourceConfig) error {
+	var problems []error
+
+	for configIdx, config := range configs {
+		for _, r := range config.Account {
+			if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.') {
+				problems = append(problems, fmt.Errorf(
+					"group %d (%s): Account %q may only have letters, digits, \"-\", \"_\" and \".\"",
+					configIdx, config.Name, config.Account,
+				))
+				break
+			}
+		}
+
+		january := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		if monthFolderName(january, config.FolderNameFormat) == monthFolderName(january.AddDate(0, 1, 0), config.FolderNameFormat) {
+			problems = append(problems, fmt.Errorf(
+				"group %d (%s): FolderNameFormat %q doesn't include the month",
+				configIdx, config.Name, config.FolderNameFormat,
+			))
+		}
+
+		groupCurrency := InvoiceGroup{Currency: config.Currency}.currency()
+		currencies := []string{groupCurrency}
+		for _, source := range config.Sources {
+			if source.Currency != "" && !slices.Contains(currencies, source.Currency) {
+				currencies = append(currencies, source.Currency)
+			}
+		}
+		if config.HomeCurrency == "" && len(currencies) > 1 {
+			problems = append(problems, fmt.Errorf(
+				"group %d (%s): sources are paid in %s, set HomeCurrency and ExchangeRates to total them",
+				configIdx, config.Name, strings.Join(currencies, ", "),
+			))
+		}
+		if config.HomeCurrency != "" {
+			for _, currency := range currencies {
+				if currency != config.HomeCurrency && config.ExchangeRates[currency] <= 0 {
+					problems = append(problems, fmt.Errorf(
+						"group %d (%s): ExchangeRates has no rate from %s to %s",
+						configIdx, config.Name, currency, config.HomeCurrency,
+					))
+				}
+			}
+		}
+
+		for sourceIdx, source := range config.Sources {
+			problem := func(format string, args ...any) {
+				problems = append(problems, fmt.Errorf(
+					"group %d (%s), source %d (%s): %s",
+					configIdx, config.Name, sourceIdx, source.BillName,
+					fmt.Sprintf(format, args...),
+				))
+			}
+
+			if len(source.From) == 0 && source.QueryOverride == "" {
+				problem("From and QueryOverride are empty")
+			}
+			if slices.Contains(source.From, "") {
+				problem("From has an empty sender")
+			}
+
+			if len(source.Location) == 0 {
+				problem("Location is empty")
+			}
+			for _, location := range source.Location {
+				switch location {
+				case "body", "attachment":
+				default:
+					problem("Location must be \"body\" or \"attachment\", got %q", location)
+				}
+			}
+
+			if source.MaxValue > 0 && source.MinValue > source.MaxValue {
+				problem("MinValue %d is above MaxValue %d", source.MinValue, source.MaxValue)
+			}
+
+			if source.ValueExpression != "" {
+				err := validateValueExpression(source.ValueExpression)
+				if err != nil {
+					problem("invalid ValueExpression: %v", err)
+				}
+			}
+
+			if source.PriceRegex != "" {
+				_, err := compilePriceRegex(source.PriceRegex)
+				if err != nil {
+					problem("invalid PriceRegex: %v", err)
+				}
+			}
+
+			_, err := source.isBillingMonth(time.Now())
+			if err != nil {
+				problem("invalid Cadence or CadenceAnchor: %v", err)
+			}
+
+			_, _, err = parsePageRange(source.PageRange)
+			if err != nil {
+				problem("invalid PageRange: %v", err)
+			}
+
+			if source.BillingPeriodRegex != "" {
+				_, err := compileBillingPeriodRegex(source.BillingPeriodRegex)
+				if err != nil {
+					problem("invalid BillingPeriodRegex: %v", err)
+				}
+			}
+
+			if source.Occurrence < -1 {
+				problem("Occurrence must be -1 (last), 0 or above, got %d", source.Occurrence)
+			}
+
+			if strings.Contains(source.FileNameTemplate, "/") {
+				problem("FileNameTemplate can't contain \"/\"")
+			}
+
+			if source.SaveBodyAsPDF && !slices.Contains(source.Location, "body") {
+				problem("SaveBodyAsPDF needs \"body\" in Location")
+			}
+
+			switch source.PDFLayout {
+			case "", "default", "layout", "raw":
+			default:
+				problem("PDFLayout must be \"default\", \"layout\" or \"raw\", got %q", source.PDFLayout)
+			}
+
+			if source.SplitByPage && source.PDFPasswordEnv != "" {
+				problem("SplitByPage can't split encrypted pdfs")
+			}
+
+			if source.SplitByPage && len(source.Extractions) > 0 {
+				problem("SplitByPage can't be combined with Extractions")
+			}
+
+			extractionNames := map[string]bool{}
+			for extractionIdx, extraction := range source.Extractions {
+				if extraction.Name == "" {
+					problem("extraction %d has no Name", extractionIdx)
+				} else if extractionNames[extraction.Name] {
+					problem("extraction Name %q is repeated", extraction.Name)
+				}
+				extractionNames[extraction.Name] = true
+
+				if extraction.PriceRegex != "" {
+					_, err := compilePriceRegex(extraction.PriceRegex)
+					if err != nil {
+						problem("extraction %q: invalid PriceRegex: %v", extraction.Name, err)
+					}
+				}
+
+				if extraction.Group != "" && !slices.ContainsFunc(configs, func(c SourceConfig) bool { return c.Name == extraction.Group }) {
+					problem("extraction %q: Group %q is not a configured group", extraction.Name, extraction.Group)
+				}
+
+				if extraction.Occurrence < -1 {
+					problem("extraction %q: Occurrence must be -1 (last), 0 or above, got %d", extraction.Name, extraction.Occurrence)
+				}
+			}
+
+			if source.SplitByPage && (len(source.Location) != 1 || source.Location[0] != "attachment") {
+				problem("SplitByPage needs Location to be \"attachment\" only")
+			}
+
+			switch source.SelectStrategy {
+			case "", selectFirst, selectLast, selectLargestAttachment, selectHasPDF:
+			default:
+				problem("SelectStrategy must be %q, %q, %q or %q, got %q", selectFirst, selectLast, selectLargestAttachment, selectHasPDF, source.SelectStrategy)
+			}
+
+			switch source.Parser {
+			case "":
+			case "words":
+				_, err = amountWordsPattern(source.ParserLanguage)
+				if err != nil {
+					problem("invalid ParserLanguage: %v", err)
+				}
+			default:
+				problem("invalid Parser %q", source.Parser)
+			}
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// Restricts the configuration to the sources selected with -only and -skip,
+// each a list of source BillNames or group Names. A group name selects or
+// skips all of its sources. Groups left without sources are dropped, and
+// names not in the configuration are an error, as they're likely typos.
+func filterSources(configs []SourceConfig, only []string, skip []string) ([]SourceConfig, error) {
+	if len(only) == 0 && len(skip) == 0 {
+		return configs, nil
+	}
+
+	known := map[string]bool{}
+	for _, config := range configs {
+		known[config.Name] = true
+		for _, source := range config.Sources {
+			known[source.BillName] = true
+		}
+	}
+
+	var unknown []string
+	for _, name := range slices.Concat(only, skip) {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown sources: %s", strings.Join(unknown, ", "))
+	}
+
+	var filtered []SourceConfig
+	for _, config := range configs {
+		selected := func(source Source) bool {
+			if slices.Contains(skip, config.Name) || slices.Contains(skip, source.BillName) {
+				return false
+			}
+			return len(only) == 0 || slices.Contains(only, config.Name) || slices.Contains(only, source.BillName)
+		}
+
+		var sources []Source
+		for _, source := range config.Sources {
+			if selected(source) {
+				sources = append(sources, source)
+			}
+		}
+
+		if len(sources) > 0 {
+			config.Sources = sources
+			filtered = append(filtered, config)
+		}
+	}
+
+	return filtered, nil
+}
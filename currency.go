@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Default currency of invoice groups that don't configure one
+const defaultCurrency = "EUR"
+
+// How amounts of a currency are written
+type currencyFormat struct {
+	Symbol string
+
+	// Separator between units and cents
+	DecimalSeparator string
+}
+
+// Formats of known currencies by ISO 4217 code. Other codes are written
+// before the amount, e.g. "CHF 12,34".
+var currencyFormats = map[string]currencyFormat{
+	"EUR": {Symbol: "€", DecimalSeparator: ","},
+	"USD": {Symbol: "$", DecimalSeparator: "."},
+	"GBP": {Symbol: "£", DecimalSeparator: "."},
+	"BRL": {Symbol: "R$", DecimalSeparator: ","},
+}
+
+// Number of decimals of the currencies whose minor unit isn't a hundredth,
+// by ISO 4217 code. Values are kept as integers of the minor unit.
+var currencyMinorUnits = map[string]int{
+	"BHD": 3,
+	"JOD": 3,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"JPY": 0,
+	"KRW": 0,
+}
+
+// Returns the number of decimals of a currency, 2 unless it's listed in
+// currencyMinorUnits
+func minorUnits(currency string) int {
+	if decimals, ok := currencyMinorUnits[currency]; ok {
+		return decimals
+	}
+	return 2
+}
+
+// Formats a value in minor units with the given number of decimals, e.g.
+// "12,34", "12.345" or "-12,34"
+func formatMinorUnits(value int64, decimals int, separator string) string {
+	if decimals == 0 {
+		return strconv.FormatInt(value, 10)
+	}
+
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+
+	unit := int64(math.Pow10(decimals))
+	return fmt.Sprintf("%s%d%s%0*d", sign, value/unit, separator, decimals, value%unit)
+}
+
+// Returns a value in minor units in the major unit of its currency, e.g.
+// 12.345 for 12345 KWD fils
+func majorUnits(value int64, currency string) float64 {
+	return float64(value) / math.Pow10(minorUnits(currency))
+}
+
+// Returns the currency of a source's invoices: its own Currency, or the
+// default currency until it's given the one of its group, see
+// scrapeInvoiceGroups
+func (s Source) currency() string {
+	if s.Currency == "" {
+		return defaultCurrency
+	}
+	return s.Currency
+}
+
+// Returns the currency of an invoice group
+func (g InvoiceGroup) currency() string {
+	if g.Currency == "" {
+		return defaultCurrency
+	}
+	return g.Currency
+}
+
+// Returns the currency of an invoice of the group
+func (g InvoiceGroup) invoiceCurrency(invoice Invoice) string {
+	if invoice.Currency == "" {
+		return g.currency()
+	}
+	return invoice.Currency
+}
+
+// Returns the currency the group's total is in: its HomeCurrency when set
+func (g InvoiceGroup) totalCurrency() string {
+	if g.HomeCurrency == "" {
+		return g.currency()
+	}
+	return g.HomeCurrency
+}
+
+// Returns the total value in cents of the group's invoices, in
+// totalCurrency. Invoices in other currencies are converted with the
+// group's ExchangeRates, which validateSources checks are all there.
+func (g InvoiceGroup) total() int64 {
+	var total int64
+	for _, invoice := range g.Invoices {
+		total += convertAmount(invoice.Value, g.invoiceCurrency(invoice), g.totalCurrency(), g.ExchangeRates)
+	}
+	return total
+}
+
+// Converts a value in minor units from one currency to another, with rates
+// holding the value of one unit of each currency in the target one. The
+// value is rescaled when the currencies have different decimals, e.g. yen
+// to euro cents.
+func convertAmount(value int64, from string, to string, rates map[string]float64) int64 {
+	if from == to {
+		return value
+	}
+	scale := math.Pow10(minorUnits(to) - minorUnits(from))
+	return int64(math.Round(float64(value) * rates[from] * scale))
+}
+
+// Returns the separator between units and cents of the currency's amounts,
+// "," for currencies without a known format
+func decimalSeparator(currency string) string {
+	if format, ok := currencyFormats[currency]; ok {
+		return format.DecimalSeparator
+	}
+	return ","
+}
+
+// Formats a value in minor units with the currency symbol, e.g. "€12,34",
+// "$12.34" or "KWD 12,345". Credits have the minus before the symbol, like
+// "-€12,34".
+func formatAmount(value int64, currency string) string {
+	format, ok := currencyFormats[currency]
+	if !ok {
+		format = currencyFormat{Symbol: currency + " ", DecimalSeparator: ","}
+	}
+
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+
+	return sign + format.Symbol + formatMinorUnits(value, minorUnits(currency), format.DecimalSeparator)
+}
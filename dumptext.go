@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Prints the text extracted from every message matching each source in the
+// months, as prices would be looked for in it, without extracting prices
+// or saving anything. Used to tune StringBeforePrice and StringAfterPrice.
+func dumpInvoiceText(months []time.Time, options Options) error {
+	configs := readConfiguration(options.ConfigPath)
+	err := validateSources(configs)
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	configs, err = filterSources(configs, options.Only, options.Skip)
+	if err != nil {
+		return fmt.Errorf("invalid -only or -skip: %w", err)
+	}
+
+	err = checkPDFTools(configs)
+	if err != nil {
+		return err
+	}
+
+	client := loadAuthenticatedGoogleClient(options.CredentialsPath, options.TokenPath)
+	accountClients := loadAccountClients(options.CredentialsPath, options.TokenPath, configs, client)
+
+	for _, month := range months {
+		// One source at a time, so their texts don't interleave
+		_, err = scrapeEmailInvoices(context.Background(), accountClients, month, configs, scrapeOptions{
+			Concurrency: 1,
+			Location:    options.Timezone,
+			CacheDir:    options.CacheDir,
+			DumpText:    os.Stdout,
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", historyKey(month), err)
+		}
+	}
+
+	return nil
+}
+
+// Writes the text of every Location of a message, between delimiter lines
+// naming the source, location and message
+func dumpMessageText(w io.Writer, msg *gmail.Message, subject string, source Source, bodyPart *gmail.MessagePart, attachmentPart *gmail.MessagePart, attachmentBytes []byte, attachmentFile string) {
+	for _, location := range source.Location {
+		fmt.Fprintf(
+			w,
+			"===== %s, %s of %q (message %s, %s) =====\n",
+			source.BillName,
+			location,
+			subject,
+			msg.Id,
+			time.UnixMilli(msg.InternalDate).Format(time.DateOnly),
+		)
+
+		invoiceText, err := extractInvoiceText(location, source, bodyPart, attachmentPart, attachmentBytes, attachmentFile)
+		if err != nil {
+			fmt.Fprintf(w, "Unable to extract text: %v\n", err)
+		} else {
+			invoiceText = source.normalizeText(invoiceText)
+			fmt.Fprint(w, invoiceText)
+			if !strings.HasSuffix(invoiceText, "\n") {
+				fmt.Fprintln(w)
+			}
+		}
+
+		fmt.Fprintf(w, "===== end of %s, %s =====\n\n", source.BillName, location)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+)
+
+// A minimal arithmetic expression over the extracted value in cents, like
+// "value + 500" or "(value - 100) / 10". Only integer literals, the `value`
+// variable, + - * / and parentheses are supported, so evaluating it can't
+// do anything but arithmetic.
+type valueExpression struct {
+	tokens []string
+	pos    int
+
+	// First evaluation error, kept aside so parsing can go on and still
+	// report syntax errors
+	evalErr error
+}
+
+// Parses and evaluates the expression for the given value
+func evaluateValueExpression(expression string, value int64) (int64, error) {
+	tokens, err := tokenizeValueExpression(expression)
+	if err != nil {
+		return 0, err
+	}
+
+	e := valueExpression{tokens: tokens}
+	result, err := e.parseSum(value)
+	if err != nil {
+		return 0, err
+	}
+	if e.pos < len(e.tokens) {
+		return 0, fmt.Errorf("unexpected %q", e.tokens[e.pos])
+	}
+	if e.evalErr != nil {
+		return 0, e.evalErr
+	}
+	return result, nil
+}
+
+// Checks that the expression is well formed
+func validateValueExpression(expression string) error {
+	_, err := evaluateValueExpression(expression, 0)
+
+	// Evaluating with zero may legitimately divide by zero,
+	// only syntax errors matter here
+	var evalErr *valueExpressionEvalError
+	if errors.As(err, &evalErr) {
+		return nil
+	}
+
+	return err
+}
+
+// Error raised while evaluating a well formed expression
+type valueExpressionEvalError struct {
+	message string
+}
+
+func (e *valueExpressionEvalError) Error() string {
+	return e.message
+}
+
+func tokenizeValueExpression(expression string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '+' || r == '-' || r == '*' || r == '/' || r == '(' || r == ')':
+			tokens = append(tokens, string(r))
+			i++
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		case unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && unicode.IsLetter(runes[i]) {
+				i++
+			}
+			name := string(runes[start:i])
+			if name != "value" {
+				return nil, fmt.Errorf("unknown variable %q", name)
+			}
+			tokens = append(tokens, name)
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New("empty expression")
+	}
+
+	return tokens, nil
+}
+
+func (e *valueExpression) peek() string {
+	if e.pos < len(e.tokens) {
+		return e.tokens[e.pos]
+	}
+	return ""
+}
+
+// sum = product (("+" | "-") product)*
+func (e *valueExpression) parseSum(value int64) (int64, error) {
+	result, err := e.parseProduct(value)
+	if err != nil {
+		return 0, err
+	}
+
+	for e.peek() == "+" || e.peek() == "-" {
+		op := e.peek()
+		e.pos++
+		right, err := e.parseProduct(value)
+		if err != nil {
+			return 0, err
+		}
+		if op == "+" {
+			result = e.checked(addInt64(result, right))
+		} else {
+			result = e.checked(subInt64(result, right))
+		}
+	}
+
+	return result, nil
+}
+
+// product = factor (("*" | "/") factor)*
+func (e *valueExpression) parseProduct(value int64) (int64, error) {
+	result, err := e.parseFactor(value)
+	if err != nil {
+		return 0, err
+	}
+
+	for e.peek() == "*" || e.peek() == "/" {
+		op := e.peek()
+		e.pos++
+		right, err := e.parseFactor(value)
+		if err != nil {
+			return 0, err
+		}
+		if op == "*" {
+			result = e.checked(mulInt64(result, right))
+		} else {
+			if right == 0 {
+				if e.evalErr == nil {
+					e.evalErr = &valueExpressionEvalError{"division by zero"}
+				}
+				continue
+			}
+			if result == math.MinInt64 && right == -1 {
+				result = e.checked(0, false)
+				continue
+			}
+			result /= right
+		}
+	}
+
+	return result, nil
+}
+
+// factor = "-" factor | "(" sum ")" | number | "value"
+func (e *valueExpression) parseFactor(value int64) (int64, error) {
+	token := e.peek()
+	e.pos++
+
+	switch {
+	case token == "":
+		return 0, errors.New("unexpected end of expression")
+	case token == "-":
+		result, err := e.parseFactor(value)
+		return e.checked(subInt64(0, result)), err
+	case token == "(":
+		result, err := e.parseSum(value)
+		if err != nil {
+			return 0, err
+		}
+		if e.peek() != ")" {
+			return 0, errors.New("missing closing parenthesis")
+		}
+		e.pos++
+		return result, nil
+	case token == "value":
+		return value, nil
+	case unicode.IsDigit(rune(token[0])):
+		return strconv.ParseInt(token, 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected %q", token)
+	}
+}
+
+// Returns result, recording an evaluation error when the operation that
+// gave it overflowed, so a wrapped value isn't taken for a real amount
+func (e *valueExpression) checked(result int64, ok bool) int64 {
+	if !ok && e.evalErr == nil {
+		e.evalErr = &valueExpressionEvalError{"value out of range"}
+	}
+	return result
+}
+
+// Adds a and b, and whether the sum didn't overflow
+func addInt64(a int64, b int64) (int64, bool) {
+	sum := a + b
+	return sum, (b >= 0) == (sum >= a)
+}
+
+// Subtracts b from a, and whether the difference didn't overflow
+func subInt64(a int64, b int64) (int64, bool) {
+	difference := a - b
+	return difference, (b >= 0) == (difference <= a)
+}
+
+// Multiplies a and b, and whether the product didn't overflow
+func mulInt64(a int64, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	product := a * b
+	return product, product/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64)
+}
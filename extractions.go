@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// One of several values extracted from the same invoice, like the energy
+// and standing charges of an electricity bill. Each becomes its own invoice
+// sharing the source's file.
+type Extraction struct {
+	// Friendly name of the value, like "Standing charge"
+	Name string `yaml:"Name"`
+
+	// What string comes imediately before the value
+	StringBeforePrice string `yaml:"StringBeforePrice"`
+
+	// What string comes imediately after the value
+	StringAfterPrice string `yaml:"StringAfterPrice"`
+
+	// Which occurrence of StringBeforePrice the value follows, see
+	// Source.Occurrence
+	Occurrence int `yaml:"Occurrence"`
+
+	// Optional regex with a named capture group `amount` used to find the
+	// value instead of StringBeforePrice and StringAfterPrice
+	PriceRegex string `yaml:"PriceRegex"`
+
+	// Name of another group the value is saved in, along with a copy of
+	// the file, e.g. for a statement covering two properties. Empty for
+	// the source's own group.
+	Group string `yaml:"Group"`
+}
+
+// Bill name of the invoice of one extraction, e.g. "Electricity (Standing
+// charge)", under which its value is recorded
+func extractionBillName(billName string, extraction Extraction) string {
+	return fmt.Sprintf("%s (%s)", billName, extraction.Name)
+}
+
+// Returns the name of the group the invoice of the named extraction is
+// saved in, see Extraction.Group. Empty for the source's own group.
+func (s Source) extractionGroup(extractionName string) string {
+	for _, extraction := range s.Extractions {
+		if extraction.Name == extractionName {
+			return extraction.Group
+		}
+	}
+	return ""
+}
+
+// Returns the invoices of a source of configs[configIdx], including those
+// of its extractions saved in other groups. invoiceGroups are in
+// configuration order.
+func sourceInvoices(configs []SourceConfig, invoiceGroups []InvoiceGroup, configIdx int, source Source) []Invoice {
+	var invoices []Invoice
+	for _, invoice := range invoiceGroups[configIdx].Invoices {
+		if isSourceBill(invoice.BillName, source) {
+			invoices = append(invoices, invoice)
+		}
+	}
+
+	for _, extraction := range source.Extractions {
+		if extraction.Group == "" || extraction.Group == configs[configIdx].Name {
+			continue
+		}
+
+		groupIdx := slices.IndexFunc(configs, func(config SourceConfig) bool { return config.Name == extraction.Group })
+		if groupIdx < 0 {
+			continue
+		}
+		for _, invoice := range invoiceGroups[groupIdx].Invoices {
+			if invoice.BillName == extractionBillName(source.BillName, extraction) {
+				invoices = append(invoices, invoice)
+			}
+		}
+	}
+
+	return invoices
+}
+
+// The source with the price delimiters of an extraction instead of its own
+func (s Source) withExtraction(extraction Extraction) Source {
+	s.StringBeforePrice = extraction.StringBeforePrice
+	s.StringAfterPrice = extraction.StringAfterPrice
+	s.Occurrence = extraction.Occurrence
+	s.PriceRegex = extraction.PriceRegex
+	return s
+}
+
+// Extracts the prices in cents of every extraction of the source from the
+// invoice text, or its single price when it has no Extractions
+func extractPrices(invoiceText string, source Source) ([]int64, error) {
+	if len(source.Extractions) == 0 {
+		priceCents, err := extractPrice(invoiceText, source)
+		if err != nil {
+			return nil, err
+		}
+		return []int64{priceCents}, nil
+	}
+
+	var prices []int64
+	for _, extraction := range source.Extractions {
+		priceCents, err := extractPrice(invoiceText, source.withExtraction(extraction))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", extraction.Name, err)
+		}
+		prices = append(prices, priceCents)
+	}
+	return prices, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default file name template of saved invoices
+const defaultFileNameTemplate = "{bill}.pdf"
+
+// Renders the file name of an invoice from a template with the
+// placeholders {bill}, {year} and {month} (of the scraped month, like
+// "2024" and "03"), {date} (the email's date, like "2024-03-10"),
+// {attachment} (the original attachment file name) and {ext} (its
+// extension, like ".xml").
+// An empty template means defaultFileNameTemplate.
+func renderFileName(template string, billName string, month time.Time, date time.Time, attachmentName string) string {
+	if template == "" {
+		template = defaultFileNameTemplate
+	}
+
+	return strings.NewReplacer(
+		"{bill}", billName,
+		"{year}", month.Format("2006"),
+		"{month}", month.Format("01"),
+		"{date}", date.Format("2006-01-02"),
+		"{attachment}", filepath.Base(attachmentName),
+		"{ext}", strings.ToLower(filepath.Ext(attachmentName)),
+	).Replace(template)
+}
+
+// Whether the file name template needs the email, so the file name isn't
+// known before fetching it
+func fileNameNeedsEmail(template string) bool {
+	return strings.Contains(template, "{date}") ||
+		strings.Contains(template, "{attachment}") ||
+		strings.Contains(template, "{ext}")
+}
+
+// Replaces the extension of a file name, e.g. for scanned invoices
+func withExtension(fileName string, extension string) string {
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName)) + extension
+}
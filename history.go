@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Extracted invoice values in cents, keyed by month ("2006-01"),
+// invoice group name and bill name.
+type History map[string]map[string]map[string]int64
+
+func historyKey(month time.Time) string {
+	return month.Format("2006-01")
+}
+
+// Reads the history file, returning an empty history if it doesn't exist yet
+func loadHistory(path string) (History, error) {
+	history := History{}
+
+	historyBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(historyBytes, &history)
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// Writes the history file atomically
+func saveHistory(path string, history History) error {
+	historyBytes, err := json.MarshalIndent(history, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, historyBytes, 0644)
+}
+
+// Returns the recorded value of a bill for the given month, if any
+func (h History) Lookup(month time.Time, group string, bill string) (int64, bool) {
+	value, ok := h[historyKey(month)][group][bill]
+	return value, ok
+}
+
+// Records the values of all found invoices for the given month
+func (h History) Record(month time.Time, invoiceGroups []InvoiceGroup) {
+	key := historyKey(month)
+
+	for _, invoiceGroup := range invoiceGroups {
+		for _, invoice := range invoiceGroup.Invoices {
+			if invoice.BillName == "" || invoice.ProcessingError != "" {
+				continue
+			}
+
+			if h[key] == nil {
+				h[key] = map[string]map[string]int64{}
+			}
+			if h[key][invoiceGroup.Name] == nil {
+				h[key][invoiceGroup.Name] = map[string]int64{}
+			}
+
+			h[key][invoiceGroup.Name][invoice.BillName] = invoice.Value
+		}
+	}
+}
+
+// Logs a heads-up for every invoice whose value is exactly the same as in
+// the previous month, which sometimes means last month's email was matched.
+func warnUnchangedValues(history History, month time.Time, invoiceGroups []InvoiceGroup) {
+	previousMonth := month.AddDate(0, -1, 0)
+
+	for _, invoiceGroup := range invoiceGroups {
+		for _, invoice := range invoiceGroup.Invoices {
+			if invoice.BillName == "" || invoice.Value == 0 {
+				continue
+			}
+
+			previousValue, ok := history.Lookup(previousMonth, invoiceGroup.Name, invoice.BillName)
+			if !ok || previousValue != invoice.Value {
+				continue
+			}
+
+			slog.Warn(
+				"Value is exactly the same as last month, double-check that the right email was matched",
+				"group", invoiceGroup.Name,
+				"bill", invoice.BillName,
+				"value", formatAmount(invoice.Value, invoiceGroup.invoiceCurrency(invoice)),
+				"previous_month", historyKey(previousMonth),
+			)
+		}
+	}
+}
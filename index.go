@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// An invoice file uploaded by a run, as recorded in the -index file
+type indexEntry struct {
+	// Drive file id or S3 key of the file
+	FileId string `json:"fileId"`
+
+	// Invoice value in cents
+	Value int64 `json:"value"`
+
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+// Uploaded invoice files, keyed by month ("2006-01"), invoice group name
+// and bill name, like History
+type Index map[string]map[string]map[string]indexEntry
+
+// How long updating the index waits for another run holding its lock, and
+// after how long a lock is considered left behind by a crashed run
+const (
+	indexLockTimeout = 10 * time.Second
+	indexLockStale   = time.Minute
+)
+
+// Reads the index file, returning an empty index if it doesn't exist yet
+func loadIndex(path string) (Index, error) {
+	index := Index{}
+
+	indexBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(indexBytes, &index)
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// Records the invoices of a month uploaded by this run
+func (idx Index) Record(month time.Time, invoiceGroups []InvoiceGroup, uploadedAt time.Time) {
+	key := historyKey(month)
+
+	for _, invoiceGroup := range invoiceGroups {
+		for _, invoice := range invoiceGroup.Invoices {
+			if invoice.StorageId == "" {
+				continue
+			}
+
+			if idx[key] == nil {
+				idx[key] = map[string]map[string]indexEntry{}
+			}
+			if idx[key][invoiceGroup.Name] == nil {
+				idx[key][invoiceGroup.Name] = map[string]indexEntry{}
+			}
+			idx[key][invoiceGroup.Name][invoice.BillName] = indexEntry{
+				FileId:     invoice.StorageId,
+				Value:      invoice.Value,
+				UploadedAt: uploadedAt.UTC(),
+			}
+		}
+	}
+}
+
+// Adds the invoices of a month uploaded by this run to the index file.
+// The file is locked while it's read and rewritten, so concurrent runs
+// don't lose each other's entries, and is replaced atomically.
+func updateIndex(path string, month time.Time, invoiceGroups []InvoiceGroup, uploadedAt time.Time) error {
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := loadIndex(path)
+	if err != nil {
+		return err
+	}
+
+	index.Record(month, invoiceGroups, uploadedAt)
+
+	indexBytes, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, indexBytes, 0644)
+}
+
+// Takes an exclusive lock on path by creating "<path>.lock", waiting for
+// other holders up to indexLockTimeout. Returns the function releasing it.
+func lockFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(indexLockTimeout)
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > indexLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is held by another run", lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
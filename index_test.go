@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdateIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	uploadedAt := time.Date(2024, time.April, 2, 10, 0, 0, 0, time.UTC)
+
+	invoiceGroups := testInvoiceGroups()
+	invoiceGroups[0].Invoices[0].StorageId = "water-id"
+
+	err := updateIndex(path, testMonth, invoiceGroups, uploadedAt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A later upload of another bill keeps the earlier entries
+	invoiceGroups = testInvoiceGroups()
+	invoiceGroups[0].Invoices[1].StorageId = "power-id"
+
+	err = updateIndex(path, testMonth, invoiceGroups, uploadedAt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	index, err := loadIndex(path)
+	if err != nil {
+		t.Fatalf("unable to read index: %v", err)
+	}
+
+	bills := index["2024-03"]["Home"]
+	if len(bills) != 2 {
+		t.Fatalf("expected both bills in the index, got %+v", index)
+	}
+	if entry := bills["Water"]; entry.FileId != "water-id" || entry.Value != 1234 || !entry.UploadedAt.Equal(uploadedAt) {
+		t.Errorf("unexpected Water entry %+v", entry)
+	}
+	if bills["Power"].FileId != "power-id" {
+		t.Errorf("unexpected Power entry %+v", bills["Power"])
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// Applies the label to the message of every successfully scraped invoice,
+// in the account it was scraped from (see Invoice.Account). The label is
+// created in accounts that don't have it yet.
+func labelScrapedMessages(ctx context.Context, accountClients map[string]*http.Client, invoiceGroups []InvoiceGroup, labelName string) error {
+	labelIds := map[string]string{}
+
+	for _, invoiceGroup := range invoiceGroups {
+		for _, invoice := range invoiceGroup.Invoices {
+			if invoice.MessageId == "" || invoice.ProcessingError != "" {
+				continue
+			}
+
+			srv, err := gmail.NewService(ctx, option.WithHTTPClient(accountClients[invoice.Account]))
+			if err != nil {
+				return fmt.Errorf("unable to retrieve Gmail client: %w", err)
+			}
+
+			labelId, ok := labelIds[invoice.Account]
+			if !ok {
+				labelId, err = findOrCreateLabel(ctx, srv, labelName)
+				if err != nil {
+					return fmt.Errorf("unable to find or create label %q: %w", labelName, err)
+				}
+				labelIds[invoice.Account] = labelId
+			}
+
+			err = withRetry(ctx, func() error {
+				_, err := srv.Users.Messages.Modify("me", invoice.MessageId, &gmail.ModifyMessageRequest{
+					AddLabelIds: []string{labelId},
+				}).Context(ctx).Do()
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("unable to label message of %s: %w", invoice.BillName, err)
+			}
+
+			slog.Debug("Labeled message", "bill", invoice.BillName, "label", labelName)
+		}
+	}
+
+	return nil
+}
+
+// Returns the id of the label with the given name, creating it if needed
+func findOrCreateLabel(ctx context.Context, srv *gmail.Service, labelName string) (string, error) {
+	var labels *gmail.ListLabelsResponse
+	err := withRetry(ctx, func() (err error) {
+		labels, err = srv.Users.Labels.List("me").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, label := range labels.Labels {
+		if label.Name == labelName {
+			return label.Id, nil
+		}
+	}
+
+	slog.Info("Creating Gmail label", "label", labelName)
+
+	var label *gmail.Label
+	err = withRetry(ctx, func() (err error) {
+		label, err = srv.Users.Labels.Create("me", &gmail.Label{
+			Name:                  labelName,
+			LabelListVisibility:   "labelShow",
+			MessageListVisibility: "show",
+		}).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return label.Id, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reads the time of the last successful incremental run, or the zero time
+// if there was none yet
+func loadLastRun(path string) (time.Time, error) {
+	lastRunBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(lastRunBytes)))
+}
+
+// Records the time of a successful incremental run
+func saveLastRun(path string, lastRun time.Time) error {
+	return writeFileAtomic(path, []byte(lastRun.UTC().Format(time.RFC3339)+"\n"), 0644)
+}
+
+// Returns the months to scrape in an incremental run: every month since
+// the one of the last run, or only the current one on the first run
+func incrementalMonths(lastRun time.Time) ([]time.Time, error) {
+	if lastRun.IsZero() {
+		month, err := parseMonth("now")
+		return []time.Time{month}, err
+	}
+
+	return monthRange(lastRun.UTC().Format("2006-01"), "")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// A plain-text accounting format in which scraped invoices can be exported
+type ledgerFormat interface {
+	// Writes one transaction per invoice
+	WriteTransactions(w io.Writer, month time.Time, invoiceGroups []InvoiceGroup, configs []SourceConfig) error
+}
+
+// Supported ledger formats by name
+var ledgerFormats = map[string]ledgerFormat{
+	"beancount": beancountFormat{},
+}
+
+// Default account of invoice expenses
+const defaultLedgerAccount = "Expenses:Invoices"
+
+// Default account invoices are paid from
+const defaultLedgerPaymentAccount = "Liabilities:Invoices"
+
+// Returns the expense account of every source, keyed by group and bill name
+func ledgerAccounts(configs []SourceConfig) map[string]map[string]string {
+	accounts := map[string]map[string]string{}
+	for _, config := range configs {
+		accounts[config.Name] = map[string]string{}
+		for _, source := range config.Sources {
+			account := source.LedgerAccount
+			if account == "" {
+				account = defaultLedgerAccount
+			}
+			accounts[config.Name][source.BillName] = account
+		}
+	}
+	return accounts
+}
+
+// Returns the account the invoices of every group are paid from
+func ledgerPaymentAccounts(configs []SourceConfig) map[string]string {
+	accounts := map[string]string{}
+	for _, config := range configs {
+		account := config.LedgerPaymentAccount
+		if account == "" {
+			account = defaultLedgerPaymentAccount
+		}
+		accounts[config.Name] = account
+	}
+	return accounts
+}
+
+// Writes transactions in Beancount syntax, e.g.
+//
+//	2024-03-01 * "Bills A" "eletricidade"
+//	  Expenses:Utilities:Electricity  12.34 EUR
+//	  Liabilities:Invoices
+type beancountFormat struct{}
+
+func beancountString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func (beancountFormat) WriteTransactions(w io.Writer, month time.Time, invoiceGroups []InvoiceGroup, configs []SourceConfig) error {
+	accounts := ledgerAccounts(configs)
+	paymentAccounts := ledgerPaymentAccounts(configs)
+
+	for _, invoiceGroup := range invoiceGroups {
+		for _, invoice := range invoiceGroup.Invoices {
+			if invoice.BillName == "" || invoice.ProcessingError != "" {
+				continue
+			}
+
+			_, err := fmt.Fprintf(
+				w,
+				"%s * %s %s\n  %s  %s %s\n  %s\n\n",
+				month.Format("2006-01-02"),
+				beancountString(invoiceGroup.Name),
+				beancountString(invoice.BillName),
+				accounts[invoiceGroup.Name][invoice.BillName],
+				formatMinorUnits(invoice.Value, minorUnits(invoiceGroup.invoiceCurrency(invoice)), "."),
+				invoiceGroup.invoiceCurrency(invoice),
+				paymentAccounts[invoiceGroup.Name],
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Appends the transactions of the scraped invoices to a ledger file
+func appendLedger(path string, formatName string, month time.Time, invoiceGroups []InvoiceGroup, configs []SourceConfig) error {
+	format, ok := ledgerFormats[formatName]
+	if !ok {
+		return fmt.Errorf("unknown ledger format %q", formatName)
+	}
+
+	// Build everything first so a failure doesn't leave half a run behind
+	transactions := bytes.Buffer{}
+	err := format.WriteTransactions(&transactions, month, invoiceGroups, configs)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(transactions.Bytes())
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
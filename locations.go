@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Ordered list of locations to look for the price in. Configuration files
+// can set a single location as a plain string, e.g. "body".
+type Locations []string
+
+func (l *Locations) UnmarshalJSON(data []byte) error {
+	var location string
+	if err := json.Unmarshal(data, &location); err == nil {
+		*l = Locations{location}
+		return nil
+	}
+
+	var locations []string
+	if err := json.Unmarshal(data, &locations); err != nil {
+		return err
+	}
+	*l = locations
+	return nil
+}
+
+func (l *Locations) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var location string
+		if err := value.Decode(&location); err != nil {
+			return err
+		}
+		*l = Locations{location}
+		return nil
+	}
+
+	var locations []string
+	if err := value.Decode(&locations); err != nil {
+		return err
+	}
+	*l = locations
+	return nil
+}
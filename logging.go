@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Makes slog (and the standard log package, which then logs at info level)
+// write messages of at least the given level to stderr, as text or JSON
+func setupLogging(level string, json bool) error {
+	var minLevel slog.Level
+	err := minLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		return err
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: minLevel}
+
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, handlerOptions)
+	if json {
+		handler = slog.NewJSONHandler(os.Stderr, handlerOptions)
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
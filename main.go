@@ -1,79 +1,330 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
 	"context"
-	"encoding/base64"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/joho/godotenv"
 	"golang.org/x/net/html"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+	"gopkg.in/yaml.v3"
 )
 
 type Source struct {
 	// Any friendly name for the invoice, like electricity, gas, water, etc.
-	BillName string
+	BillName string `yaml:"BillName"`
+
+	// Invoice sender email, or a list of them for providers sending from
+	// several addresses. A domain, like "acme.com", matches all of its
+	// addresses.
+	From Senders `yaml:"From"`
 
-	// Invoice sender email
-	From string
+	// Gmail search query used verbatim instead of the one built from From,
+	// SubjectContains and Label, e.g. "from:(a OR b) -subject:reminder
+	// has:attachment". The month's date window is still added to it.
+	QueryOverride string `yaml:"QueryOverride"`
 
 	// Filter invoice emails by subject that contains this string
-	SubjectContains string
+	SubjectContains string `yaml:"SubjectContains"`
+
+	// Optional Gmail label the invoice emails have, e.g. "bills"
+	Label string `yaml:"Label"`
+
+	// Name of the saved invoice file, with the placeholders {bill}, {year},
+	// {month}, {date} (of the email), {attachment} (the original attachment
+	// file name) and {ext} (its extension), e.g. "{bill}-{date}.pdf" or
+	// "{bill}-{attachment}". Defaults to "{bill}.pdf".
+	FileNameTemplate string `yaml:"FileNameTemplate"`
 
-	// Where the price can be found, either "body" or "attachment"
-	Location string
+	// Only pick attachments whose file name contains this string. When
+	// several match, the largest one is used.
+	AttachmentNameContains string `yaml:"AttachmentNameContains"`
+
+	// Where the price can be found, "body" or "attachment", or a list of
+	// both to try in order until one has the price
+	Location Locations `yaml:"Location"`
 
 	// What string comes imediately before the price
-	StringBeforePrice string
+	StringBeforePrice string `yaml:"StringBeforePrice"`
 
 	// What string comes imediately after the price
-	StringAfterPrice string
+	StringAfterPrice string `yaml:"StringAfterPrice"`
+
+	// Optional regex finding the month the invoice bills in its text, with
+	// named capture groups `year` and `month` (a number), e.g.
+	// "Period: (?P<month>\\d{2})/(?P<year>\\d{4})". Invoices are then saved in
+	// the folder of that month instead of the scraped one.
+	BillingPeriodRegex string `yaml:"BillingPeriodRegex"`
+
+	// Which occurrence of StringBeforePrice the price follows, 1 (the
+	// default) for the first, 2 for the second and so on, or -1 for the last
+	Occurrence int `yaml:"Occurrence"`
+
+	// Optional separator the cells of html body table rows are joined with,
+	// e.g. " | ", so a row reads "Total | €12,34" instead of one line per cell
+	TableCellSeparator string `yaml:"TableCellSeparator"`
+
+	// Whether runs of whitespace and line breaks in the invoice text, and in
+	// the delimiters, are collapsed into single spaces before looking for
+	// the price, so "Total due\n€12,34" matches "Total due €"
+	CollapseWhitespace bool `yaml:"CollapseWhitespace"`
+
+	// Optional string that must appear in the invoice text, otherwise the
+	// message is not trusted as an invoice of this source
+	RequireAnchor string `yaml:"RequireAnchor"`
+
+	// Optional arithmetic expression applied to the extracted value in cents,
+	// e.g. "value + 500" or "value / 10"
+	ValueExpression string `yaml:"ValueExpression"`
+
+	// Optional bounds in minor units (cents for most currencies) of the
+	// final value, after ValueExpression.
+	// Values outside them are treated as parse failures. 0 means no bound.
+	MinValue int64 `yaml:"MinValue"`
+	MaxValue int64 `yaml:"MaxValue"`
+
+	// How the price is written, either "" (numeric, the default) or "words"
+	// for amounts spelled out like "12 euros and 34 cents"
+	Parser string `yaml:"Parser"`
+
+	// Language of the "words" parser: "en" (default), "pt" or "es"
+	ParserLanguage string `yaml:"ParserLanguage"`
+
+	// Attachment pages to look for the price in, like "2", "1-3" or "all".
+	// Defaults to the first page only.
+	PageRange string `yaml:"PageRange"`
+
+	// Name of the environment variable (or .env entry) holding the password
+	// of encrypted pdf attachments, e.g. "BANK_PDF_PASSWORD"
+	PDFPasswordEnv string `yaml:"PDFPasswordEnv"`
+
+	// pdftotext layout mode: "default", "layout" to keep the physical layout,
+	// which keeps table columns on the same line, or "raw" for the content
+	// stream order. Not used by the go -pdf-backend.
+	PDFLayout string `yaml:"PDFLayout"`
+
+	// Whether the pdf attachment holds several statements, one per page, in
+	// which case every page becomes its own invoice, named like
+	// "<BillName>-p2", with its price parsed from that page alone.
+	// PageRange then selects the pages, defaulting to all of them.
+	SplitByPage bool `yaml:"SplitByPage"`
+
+	// Whether the html body of emails without an attachment is saved as
+	// the invoice pdf, rendered with wkhtmltopdf. Needs "body" in Location.
+	SaveBodyAsPDF bool `yaml:"SaveBodyAsPDF"`
+
+	// Command extracting the text of image (PNG, JPEG...) attachments,
+	// reading the image from stdin and writing the text to stdout, e.g.
+	// "tesseract stdin stdout". Image attachments fail without it.
+	OCRCommand string `yaml:"OCRCommand"`
+
+	// Which of the messages matching the source is used: "first" (the
+	// newest, default), "last" (the oldest), "largest-attachment" or
+	// "has-pdf" (the newest with a pdf attachment)
+	SelectStrategy string `yaml:"SelectStrategy"`
+
+	// Optional regex with a named capture group `amount` used to find the
+	// price instead of StringBeforePrice and StringAfterPrice, e.g.
+	// "Total amount due: (?P<amount>[\\d.,]+)"
+	PriceRegex string `yaml:"PriceRegex"`
+
+	// Several values to extract from the same invoice instead of a single
+	// price, each with its own delimiters, e.g. the energy and standing
+	// charges of an electricity bill. Each becomes an invoice named like
+	// "<BillName> (<Name>)" sharing the file. With a PageRange of several
+	// pages, the page holding the first one is used.
+	Extractions []Extraction `yaml:"Extractions"`
+
+	// Separator between units and cents. When neither separator is set, the
+	// format of each amount is detected (see parseAmount); otherwise
+	// defaults to ",".
+	DecimalSeparator string `yaml:"DecimalSeparator"`
+
+	// Separator between groups of thousands, defaults to "." when only
+	// DecimalSeparator is set
+	ThousandsSeparator string `yaml:"ThousandsSeparator"`
+
+	// ISO 4217 code of the currency this source bills in, when it differs
+	// from the group's Currency, e.g. a subscription paid in "USD". The
+	// group then needs a HomeCurrency to total its invoices in.
+	Currency string `yaml:"Currency"`
+
+	// How often invoices arrive: "monthly" (default), "quarterly" or "annual"
+	Cadence string `yaml:"Cadence"`
+
+	// A month in YYYY-MM format in which an invoice is expected, from which
+	// the other billing months are derived. Defaults to January.
+	CadenceAnchor string `yaml:"CadenceAnchor"`
+
+	// Ledger account of the invoice expense, e.g.
+	// "Expenses:Utilities:Electricity". Defaults to "Expenses:Invoices".
+	LedgerAccount string `yaml:"LedgerAccount"`
+
+	// Whether an alert is sent in -watch mode when the invoice hasn't
+	// arrived by DeadlineDay
+	Required bool `yaml:"Required"`
+
+	// Day of the month by which a required invoice is expected, defaults to 28
+	DeadlineDay int `yaml:"DeadlineDay"`
+
+	// Alert sent when a required invoice is missing, defaults to
+	// "<BillName> invoice not received yet"
+	MissingAlert string `yaml:"MissingAlert"`
 }
 
 type SourceConfig struct {
 	// Friendly name for the invoice source group
-	Name string
+	Name string `yaml:"Name"`
 
-	// Google drive folder ID, you can find it in the url
-	DriveDestination string
+	// Google drive folder ID, you can find it in the url.
+	// When empty, it is read from the DRIVE_DEST_<NAME> environment variable,
+	// see driveDestinationEnv.
+	DriveDestination string `yaml:"DriveDestination"`
+
+	// Name of the Gmail account the group's invoices arrive at, which has
+	// its own token file (see accountTokenPath). Empty for the account of
+	// the -token file, which is also the one invoices are saved with.
+	Account string `yaml:"Account"`
+
+	// Ledger account the group's invoices are paid from, e.g.
+	// "Assets:Bank:Checking". Defaults to "Liabilities:Invoices".
+	LedgerPaymentAccount string `yaml:"LedgerPaymentAccount"`
+
+	// Optional text/template for the month folder description, e.g.
+	// "Invoices for {{.Month.Format "January 2006"}} — total {{.Total}} €"
+	FolderDescriptionTemplate string `yaml:"FolderDescriptionTemplate"`
+
+	// Go time layout of the month folder names, e.g. "2006-01" for
+	// "2024-03". Defaults to "2006_1", i.e. "2024_3".
+	FolderNameFormat string `yaml:"FolderNameFormat"`
+
+	// Whether DriveDestination is in a Shared Drive, which the Drive API
+	// only looks into when asked to
+	SharedDrive bool `yaml:"SharedDrive"`
+
+	// ISO 4217 code of the currency invoices are paid in, like "EUR"
+	// (default) or "USD". Amounts are parsed with the source's separators
+	// regardless, this sets the symbol shown in notifications.
+	Currency string `yaml:"Currency"`
+
+	// ISO 4217 code of the currency the notification total is shown in,
+	// when the group's sources are paid in different currencies (see the
+	// source's Currency). Each invoice is converted with ExchangeRates.
+	HomeCurrency string `yaml:"HomeCurrency"`
+
+	// Static rates converting the group's currencies to HomeCurrency, as
+	// the value of one unit of each, e.g. {"USD": 0.92} with "EUR" home
+	ExchangeRates map[string]float64 `yaml:"ExchangeRates"`
+
+	// Optional google spreadsheet ID, from its url, to which a row with
+	// the month's values and total is appended on every run
+	SheetID string `yaml:"SheetID"`
 
 	// List of invoice sources
-	Sources []Source
+	Sources []Source `yaml:"Sources"`
 }
 
 type Invoice struct {
+	// Friendly name of the source the invoice was found for
+	BillName string
+
 	// Invoice pdf file name with extension
 	FileName string
 
-	// Invoice raw pdf file contents
-	FileContents []byte
+	// Invoice raw pdf file contents, not kept in the -notify-state file
+	FileContents []byte `json:"-"`
+
+	// Path of the invoice pdf on disk, used instead of FileContents when
+	// attachments are streamed to disk
+	FilePath string
+
+	// Invoice price value in the minor units of its currency: cents for
+	// most, but e.g. fils (thousandths) for KWD, see minorUnits
+	Value int64
+
+	// Original file name of the email attachment
+	AttachmentName string
+
+	// Size of the email attachment in bytes
+	AttachmentSize int
+
+	// MIME type the email attachment was declared with
+	AttachmentType string
+
+	// Why the invoice couldn't be scraped or saved, empty on success
+	ProcessingError string
+
+	// Something odd about an invoice that was still saved, e.g. a zero value
+	Warning string
+
+	// ISO 4217 code of the invoice currency, when it differs from its group's
+	Currency string
+
+	// Id of the Gmail message the invoice was scraped from
+	MessageId string
+
+	// Gmail account of the message, the Account of the source's group. Kept
+	// since extractions may be saved in a group of another account.
+	Account string
+
+	// Name of the source's Extraction the value is of, when it has several.
+	// The file is then shared with the invoices of the other extractions.
+	Extraction string
+
+	// First day of the month the invoice bills, found with the source's
+	// BillingPeriodRegex. Zero when unknown.
+	BillingPeriod time.Time
+
+	// Whether the invoice was already saved by a previous run, in which case
+	// it was not fetched again and has no contents
+	AlreadySaved bool
 
-	// Invoice price value in cents
-	Value uint64
+	// Where the invoice file was uploaded to by this run, its Drive file id
+	// or S3 key. Empty when it wasn't uploaded.
+	StorageId string
 }
 
-func (i Invoice) String() string {
+// Short description of the invoice for logs, like "Water.pdf: 1234". Not a
+// String method, so %v and %+v still print every field.
+func (i Invoice) Summary() string {
 	return fmt.Sprintf("%s: %d", i.FileName, i.Value)
 }
 
-func (i Invoice) Format(f fmt.State, c rune) (int, error) {
-	return f.Write([]byte(i.String()))
+// Returns the link to the Gmail message the invoice was scraped from, empty
+// when unknown
+func (i Invoice) messageLink() string {
+	if i.MessageId == "" {
+		return ""
+	}
+	return "https://mail.google.com/mail/u/0/#all/" + i.MessageId
 }
 
 type InvoiceGroup struct {
@@ -83,71 +334,284 @@ type InvoiceGroup struct {
 	// Google drive folder ID, you can find it in the url
 	DriveDestination string
 
+	// Optional text/template for the month folder description
+	FolderDescriptionTemplate string
+
+	// Go time layout of the month folder name, defaults to "2006_1"
+	FolderNameFormat string
+
+	// Whether DriveDestination is in a Shared Drive
+	SharedDrive bool
+
+	// ISO 4217 code of the invoices currency, defaults to "EUR"
+	Currency string
+
+	// ISO 4217 code of the currency the total is converted to, when set
+	HomeCurrency string
+
+	// Value of one unit of each currency in HomeCurrency
+	ExchangeRates map[string]float64
+
 	// List of invoices
 	Invoices []Invoice
 }
 
+// Data available to the folder description template
+type folderDescriptionData struct {
+	// Friendly name for the invoice group
+	Name string
+
+	// First day of the month the invoices belong to
+	Month time.Time
+
+	// Sum of all invoice values in the group, in its HomeCurrency when set,
+	// formatted like "12,34" or "12.34" depending on the currency
+	Total string
+}
+
+// Formats a cents value as a "%d,%02d" string
+func formatCents(value int64) string {
+	return formatMinorUnits(value, 2, ",")
+}
+
+// Renders the folder description template of an invoice group.
+// Returns an empty string if the group has no template.
+func renderFolderDescription(invoiceGroup InvoiceGroup, month time.Time) (string, error) {
+	if invoiceGroup.FolderDescriptionTemplate == "" {
+		return "", nil
+	}
+
+	tmpl, err := template.New("description").Parse(invoiceGroup.FolderDescriptionTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	description := strings.Builder{}
+	err = tmpl.Execute(&description, folderDescriptionData{
+		Name:  invoiceGroup.Name,
+		Month: month,
+		Total: formatMinorUnits(invoiceGroup.total(), minorUnits(invoiceGroup.totalCurrency()), decimalSeparator(invoiceGroup.totalCurrency())),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return description.String(), nil
+}
+
 // Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
-	// time.
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
+func getClient(config *oauth2.Config, tokFile string, tokEnv string) *http.Client {
+	// The token file (token.json by default) stores the user's access and
+	// refresh tokens, and is created automatically when the authorization
+	// flow completes for the first time.
+	tok, err := tokenFromFile(tokFile, tokEnv)
 	if err != nil {
 		tok = getTokenFromWeb(config)
-		saveToken(tokFile, tok)
+		err = saveToken(tokFile, tok)
+		if err != nil {
+			log.Fatalf("Unable to cache oauth token: %v", err)
+		}
+	}
+
+	ctx := oauth2Context(context.Background())
+	tokenSource := &persistingTokenSource{
+		source: config.TokenSource(ctx, tok),
+		path:   tokFile,
+		last:   tok,
+	}
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(tok, tokenSource))
+}
+
+// Token source saving refreshed tokens back to the token file, so the
+// refresh token google may rotate along with them doesn't go stale
+type persistingTokenSource struct {
+	source oauth2.TokenSource
+	path   string
+	last   *oauth2.Token
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.AccessToken != s.last.AccessToken || tok.RefreshToken != s.last.RefreshToken {
+		err = saveToken(s.path, tok)
+		if err != nil {
+			slog.Warn("Unable to save refreshed oauth token", "path", s.path, "error", err)
+		}
+		s.last = tok
 	}
-	return config.Client(context.Background(), tok)
+
+	return tok, nil
 }
 
 // Request a token from the web, then returns the retrieved token.
+// The authorization code is captured by a temporary local server the
+// browser is redirected to, or pasted by hand when it can't be started.
 func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		log.Fatalf("Unable to generate OAuth state: %v", err)
+	}
 
 	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		slog.Warn("Unable to start a local server for the authorization code, falling back to pasting it", "error", err)
+		authCode = authCodeFromPrompt(config)
+	} else {
+		authCode, err = authCodeFromLocalServer(config, listener, hex.EncodeToString(state))
+		if err != nil {
+			log.Fatalf("Unable to retrieve token from web: %v", err)
+		}
 	}
 
-	tok, err := config.Exchange(context.TODO(), authCode)
+	tok, err := config.Exchange(oauth2Context(context.TODO()), authCode)
 	if err != nil {
 		log.Fatalf("Unable to retrieve token from web: %v", err)
 	}
 	return tok
 }
 
-// Retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+// Returns the url of the google consent page
+func authCodeURL(config *oauth2.Config, state string) string {
+	// Forcing consent makes google issue a refresh token again when
+	// re-authorizing an account
+	return config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+}
+
+// Redirects the consent page to the local listener and waits for the
+// browser to come back with the authorization code
+func authCodeFromLocalServer(config *oauth2.Config, listener net.Listener, state string) (string, error) {
+	config.RedirectURL = fmt.Sprintf("http://localhost:%d/", listener.Addr().(*net.TCPAddr).Port)
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			if query.Get("state") != state {
+				http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+				return
+			}
+
+			if authErr := query.Get("error"); authErr != "" {
+				fmt.Fprintf(w, "Authorization failed: %s. You can close this window.", authErr)
+				errs <- fmt.Errorf("authorization failed: %s", authErr)
+				return
+			}
+
+			fmt.Fprint(w, "Authorization complete. You can close this window.")
+			codes <- query.Get("code")
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fmt.Printf("Go to the following link in your browser to authorize access: \n%v\n", authCodeURL(config, state))
+
+	select {
+	case code := <-codes:
+		return code, nil
+	case err := <-errs:
+		return "", err
+	}
+}
+
+// Asks the user to paste the authorization code shown by google
+func authCodeFromPrompt(config *oauth2.Config) string {
+	fmt.Printf("Go to the following link in your browser then type the "+
+		"authorization code: \n%v\n", authCodeURL(config, "state-token"))
+
+	var authCode string
+	if _, err := fmt.Scan(&authCode); err != nil {
+		log.Fatalf("Unable to read authorization code: %v", err)
+	}
+
+	return authCode
+}
+
+// Retrieves a token from a local file, or from the env environment
+// variable when the file doesn't exist.
+func tokenFromFile(file string, env string) (*oauth2.Token, error) {
+	b, err := readFileOrEnv(file, env)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
+	err = json.Unmarshal(b, tok)
 	return tok, err
 }
 
+// Writes data to a temporary file next to path and renames it into place,
+// so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
 // Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+func saveToken(path string, token *oauth2.Token) error {
+	slog.Info("Saving credential file", "path", path)
+
+	tokenBytes, err := json.Marshal(token)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return err
+	}
+
+	return writeFileAtomic(path, tokenBytes, 0600)
+}
+
+// Arguments opening a pdf with the given password, none without one
+func pdftotextPasswordArgs(password string) []string {
+	if password == "" {
+		return nil
+	}
+	return []string{"-upw", password}
+}
+
+// Arguments selecting a pdftotext layout mode, see Source.PDFLayout
+func pdftotextLayoutArgs(layout string) []string {
+	switch layout {
+	case "layout":
+		return []string{"-layout"}
+	case "raw":
+		return []string{"-raw"}
+	default:
+		return nil
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
 }
 
 // Extracts the content of a pdf page and returns it as a string.
-// Uses pdftotext cli tool.
-func extractPDFPageContent(source *bytes.Reader, pageNum int) (string, error) {
-	// TODO find a good enough library instead of relying in an external cli tool
-	// Already tried pdfcpu and it didn't work with all my invoice pdfs unfortunately
-	cmd := exec.Command("pdftotext", "-f", strconv.Itoa(pageNum), "-l", strconv.Itoa(pageNum), "-", "-")
+// Encrypted pdfs are opened with password, empty for unprotected ones.
+// Uses pdftotext cli tool, in the given layout mode.
+func pdftotextPageContent(source io.Reader, pageNum int, password string, layout string) (string, error) {
+	// Already tried pdfcpu and it didn't work with all my invoice pdfs
+	// unfortunately, see extractPDFPageContent for the pure Go backend
+	args := append(pdftotextPasswordArgs(password), pdftotextLayoutArgs(layout)...)
+	args = append(args, "-f", strconv.Itoa(pageNum), "-l", strconv.Itoa(pageNum), "-", "-")
+	cmd := exec.Command(pdftotextPath, args...)
 	cmd.Stdin = source
 
 	out, err := cmd.Output()
@@ -159,432 +623,2172 @@ func extractPDFPageContent(source *bytes.Reader, pageNum int) (string, error) {
 	return string(out), nil
 }
 
-// Finds and extracts a price value formatted as '%d,%d' in the `haystack`
-// by looking for adjacent strings `firstString` and `secondString`.
-func extractPriceBetweenTwoStrings(haystack string, firstString string, secondString string) (uint64, error) {
-	priceLineIndex := strings.Index(haystack, firstString)
+// "€" encoded in UTF-8 and decoded as Windows-1252, as found in emails with
+// a wrong charset
+const euroMojibake = "â‚¬"
+
+// Strips whitespace, currency symbols, currency codes and words in any
+// language on either side of an amount, so "€12,34", "12,34 €", "EUR12,34",
+// "12,34 euros" and "12,34 â‚¬" all become "12,34".
+func stripCurrency(amount string) string {
+	amount = strings.ReplaceAll(amount, euroMojibake, "€")
+	return strings.TrimFunc(amount, func(r rune) bool {
+		return unicode.IsSpace(r) ||
+			unicode.Is(unicode.Sc, r) ||
+			unicode.IsLetter(r)
+	})
+}
+
+// Strips the currency from an amount and cuts its sign: a leading minus,
+// like "-12,34 €" or "€ -12,34", or accounting-style parentheses, like
+// "(12,34)", mark credits. Returns the unsigned amount and whether it's
+// negative.
+func cutSign(amount string) (string, bool) {
+	amount = stripCurrency(amount)
 
-	newLineIndex := strings.Index(haystack[priceLineIndex+len(firstString):], secondString)
+	if rest, ok := strings.CutPrefix(amount, "-"); ok {
+		return stripCurrency(rest), true
+	}
+	if rest, ok := strings.CutPrefix(amount, "−"); ok {
+		return stripCurrency(rest), true
+	}
+	if strings.HasPrefix(amount, "(") && strings.HasSuffix(amount, ")") {
+		return stripCurrency(amount[1 : len(amount)-1]), true
+	}
 
-	euros := haystack[priceLineIndex+len(firstString) : priceLineIndex+len(firstString)+newLineIndex]
+	return amount, false
+}
 
-	euros = strings.Trim(euros, " \n\t€abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+// Negates a value parsed from an amount with a sign, see cutSign
+func signed(value int64, negative bool) int64 {
+	if negative {
+		return -value
+	}
+	return value
+}
 
-	cents := strings.Replace(euros, ",", "", 1)
-	cents = strings.Replace(cents, ".", "", 1)
+// Parses a page range like "2", "1-3" or "all" into its first and last
+// page. A last page of 0 means up to the end of the document.
+func parsePageRange(pageRange string) (int, int, error) {
+	switch pageRange {
+	case "":
+		return 1, 1, nil
+	case "all":
+		return 1, 0, nil
+	}
 
-	centsValue, err := strconv.ParseUint(cents, 10, 16)
+	firstString, lastString, isRange := strings.Cut(pageRange, "-")
+	if !isRange {
+		lastString = firstString
+	}
 
+	first, err := strconv.Atoi(strings.TrimSpace(firstString))
 	if err != nil {
-		return 0, err
+		return 0, 0, fmt.Errorf("invalid page range %q", pageRange)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(lastString))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid page range %q", pageRange)
+	}
+
+	if first < 1 || last < first {
+		return 0, 0, fmt.Errorf("invalid page range %q", pageRange)
 	}
 
-	return centsValue, nil
+	return first, last, nil
 }
 
-// Extracts all the textual content of a html page and returns it as a string
-func extractTextFromHtml(input string) string {
-	builder := strings.Builder{}
-	domDocTest := html.NewTokenizer(strings.NewReader(input))
-	previousStartTokenTest := domDocTest.Token()
-loopDomTest:
-	for {
-		tt := domDocTest.Next()
-		switch {
-		case tt == html.ErrorToken:
-			break loopDomTest // End of the document,  done
-		case tt == html.StartTagToken:
-			previousStartTokenTest = domDocTest.Token()
-		case tt == html.TextToken:
-			if previousStartTokenTest.Data == "script" || previousStartTokenTest.Data == "style" {
-				continue
-			}
-			TxtContent := strings.TrimSpace(html.UnescapeString(string(domDocTest.Text())))
-			if len(TxtContent) > 0 {
-				builder.WriteString(TxtContent + "\n")
-			}
-		}
+// Extracts the content of each pdf page in the range [first, last] and
+// returns them one string per page. A last page of 0 means up to the end.
+// Uses pdftotext cli tool, which separates pages with form feeds.
+func pdftotextPages(source io.Reader, first int, last int, password string, layout string) ([]string, error) {
+	args := append(pdftotextPasswordArgs(password), pdftotextLayoutArgs(layout)...)
+	args = append(args, "-f", strconv.Itoa(first))
+	if last > 0 {
+		args = append(args, "-l", strconv.Itoa(last))
 	}
-	return builder.String()
-}
+	args = append(args, "-", "-")
 
-// Scrapes the email inbox for invoices and returns them
-func scrapeEmailInvoices(client *http.Client, month time.Time, configs []SourceConfig) []InvoiceGroup {
-	ctx := context.Background()
+	cmd := exec.Command(pdftotextPath, args...)
+	cmd.Stdin = source
+
+	out, err := cmd.Output()
 
-	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
 	}
 
-	user := "me"
-
-	nextMonth := month.AddDate(0, 1, 0)
-
-	invoiceGroups := make([]InvoiceGroup, len(configs))
+	pages := strings.Split(string(out), "\f")
 
-	for configIdx, config := range configs {
-		invoiceGroups[configIdx].Name = config.Name
-		invoiceGroups[configIdx].DriveDestination = config.DriveDestination
-		invoiceGroups[configIdx].Invoices = make([]Invoice, len(config.Sources))
-		for sourceIdx, source := range config.Sources {
-			query := fmt.Sprintf(
-				"after:%d/%d/%d before:%d/%d/%d from:%s",
-				month.Year(), month.Month(), month.Day(),
-				nextMonth.Year(), nextMonth.Month(), nextMonth.Day(),
-				source.From,
-			)
-			msgs, err := srv.Users.Messages.List(user).Q(query).Do()
+	// pdftotext ends every page with a form feed
+	if len(pages) > 1 && strings.TrimSpace(pages[len(pages)-1]) == "" {
+		pages = pages[:len(pages)-1]
+	}
 
-			if err != nil {
-				log.Fatalf("Unable to retrieve messages: %v", err)
-			}
-			if len(msgs.Messages) == 0 {
-				fmt.Println("No messages found.")
-			}
+	return pages, nil
+}
 
-			for _, m := range msgs.Messages {
-				msg, err := srv.Users.Messages.Get(user, m.Id).Do()
-				if err != nil {
-					log.Fatalf("Unable to retrieve message: %v", err)
-				}
-				internalDate := time.UnixMilli(msg.InternalDate)
+// Extracts the text of a pdf attachment in which the price is searched.
+// Scans the pages in `pageRange` and returns the first one containing both
+// price delimiters, or all of them concatenated if none does.
+func extractPDFText(pdf io.Reader, pageRange string, password string, layout string, firstString string, secondString string) (string, error) {
+	first, last, err := parsePageRange(pageRange)
+	if err != nil {
+		return "", err
+	}
 
-				if internalDate.Before(month) || internalDate.After(nextMonth) {
-					log.Fatalf("Email is outside of time range")
-				}
+	if first == last {
+		return extractPDFPageContent(pdf, first, password, layout)
+	}
 
-				// Find subject
-				var subjectHeader *gmail.MessagePartHeader
-				for _, h := range msg.Payload.Headers {
+	pages, err := extractPDFPages(pdf, first, last, password, layout)
+	if err != nil {
+		return "", err
+	}
 
-					if h.Name != "Subject" {
-						continue
-					}
+	for _, page := range pages {
+		beforeIndex := strings.Index(page, firstString)
+		if beforeIndex >= 0 && strings.Contains(page[beforeIndex+len(firstString):], secondString) {
+			return page, nil
+		}
+	}
 
-					if !strings.Contains(h.Value, source.SubjectContains) {
-						continue
-					}
+	return strings.Join(pages, "\n"), nil
+}
 
-					subjectHeader = h
-					break
-				}
+// Finds the start of the given occurrence of substr in s: 1 for the first
+// (as does 0), 2 for the second and so on, or -1 for the last one.
+// Returns -1 when there aren't that many occurrences.
+func indexOccurrence(s string, substr string, occurrence int) int {
+	if occurrence == -1 {
+		return strings.LastIndex(s, substr)
+	}
 
-				if subjectHeader == nil {
-					continue
-				}
+	index := -1
+	for n := 0; n < max(occurrence, 1); n++ {
+		next := strings.Index(s[index+1:], substr)
+		if next < 0 {
+			return -1
+		}
+		index += 1 + next
+	}
 
-				fmt.Printf("%s | %v\n", subjectHeader.Value, internalDate)
+	return index
+}
 
-				// Find attachment
-				var attachmentPart *gmail.MessagePart
-				var bodyPart *gmail.MessagePart
-				for _, part := range msg.Payload.Parts {
-					if bodyPart == nil && part.MimeType == "text/html" {
-						bodyPart = part
-					} else if attachmentPart == nil && part.Filename != "" && part.Body != nil && part.Body.AttachmentId != "" {
-						attachmentPart = part
-					}
-				}
+// Finds and extracts a price value written in `format` in the `haystack`
+// by looking for adjacent strings `firstString` and `secondString`, after
+// the given occurrence of `firstString` (see indexOccurrence).
+func extractPriceBetweenTwoStrings(haystack string, firstString string, secondString string, occurrence int, format numberFormat) (int64, error) {
+	priceLineIndex := indexOccurrence(haystack, firstString, occurrence)
+	if priceLineIndex < 0 && occurrence > 1 {
+		return 0, fmt.Errorf("occurrence %d of %q not found", occurrence, firstString)
+	}
+	if priceLineIndex < 0 {
+		return 0, fmt.Errorf("%q not found", firstString)
+	}
 
-				if attachmentPart == nil {
-					fmt.Printf("No attachment found\n")
-					continue
-				}
+	newLineIndex := strings.Index(haystack[priceLineIndex+len(firstString):], secondString)
+	if newLineIndex < 0 {
+		return 0, fmt.Errorf("%q not found after %q", secondString, firstString)
+	}
 
-				fmt.Printf("Attachment found: %s\n", attachmentPart.Filename)
+	euros := haystack[priceLineIndex+len(firstString) : priceLineIndex+len(firstString)+newLineIndex]
 
-				attachment, err := srv.Users.Messages.Attachments.Get(
-					user, msg.Id, attachmentPart.Body.AttachmentId,
-				).Do()
+	return parseCents(euros, format)
+}
 
-				if err != nil {
-					log.Fatalf("Unable to retrieve attachment: %v", err)
-				}
+// Separators used to write amounts, e.g. "1.234,56" or "1,234.56", and
+// the number of decimals of their currency, see minorUnits
+type numberFormat struct {
+	DecimalSeparator   string
+	ThousandsSeparator string
+	Decimals           int
+}
 
-				attachmentBytes, err := base64.URLEncoding.DecodeString(attachment.Data)
+// Whether the separators of amounts are detected, see parseAmount
+func (f numberFormat) detected() bool {
+	return f.DecimalSeparator == "" && f.ThousandsSeparator == ""
+}
 
-				if err != nil {
-					log.Fatalf("Unable to decode attachment: %v", err)
-				}
+// Returns the number format of the source. Without any separator set, the
+// format is detected from each amount, see parseAmount. With only one of
+// them set, the other defaults to "1.234,56".
+func (s Source) numberFormat() numberFormat {
+	format := numberFormat{
+		DecimalSeparator:   s.DecimalSeparator,
+		ThousandsSeparator: s.ThousandsSeparator,
+		Decimals:           minorUnits(s.currency()),
+	}
+	if format.detected() {
+		return format
+	}
+	if format.DecimalSeparator == "" {
+		format.DecimalSeparator = ","
+	}
+	if format.ThousandsSeparator == "" {
+		format.ThousandsSeparator = "."
+	}
+	return format
+}
 
-				var invoiceText string
-				switch source.Location {
-				case "body":
-					if bodyPart == nil {
-						log.Fatalf("Unable to find body part")
-					}
-					decodedBody, err := base64.URLEncoding.DecodeString(bodyPart.Body.Data)
+// Converts an amount written in the given number format into minor units
+// (cents for most currencies), or in the format detected by parseAmount
+// when it has no separators. Amounts with more decimal digits than the
+// format's Decimals are rejected. Credits are negative, see cutSign.
+func parseCents(amount string, format numberFormat) (int64, error) {
+	if format.detected() {
+		return parseAmount(amount, format.Decimals)
+	}
 
-					if err != nil {
-						log.Fatalf("Unable to decode body: %v", err)
-					}
-					decodedBodyString := string(decodedBody)
+	euros, negative := cutSign(amount)
 
-					invoiceText = extractTextFromHtml(decodedBodyString)
-				case "attachment":
-					invoiceText, err = extractPDFPageContent(bytes.NewReader(attachmentBytes), 1)
+	euros = strings.ReplaceAll(euros, format.ThousandsSeparator, "")
 
-					if err != nil {
-						log.Fatalf("Unable to extract page content: %v", err)
-					}
-				}
+	units, decimals, _ := strings.Cut(euros, format.DecimalSeparator)
+	if len(decimals) > format.Decimals {
+		return 0, fmt.Errorf("too many decimal digits in %q", amount)
+	}
 
-				// fmt.Printf("invoiceText: %v\n", invoiceText)
+	cents := units + decimals + strings.Repeat("0", format.Decimals-len(decimals))
 
-				priceCents, err := extractPriceBetweenTwoStrings(
-					invoiceText,
-					source.StringBeforePrice,
-					source.StringAfterPrice,
-				)
+	if strings.Trim(cents, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
 
-				if err != nil {
-					log.Fatalf("Unable to extract price: %v", err)
-				}
+	centsValue, err := strconv.ParseInt(cents, 10, 64)
 
-				fmt.Printf("Extracted price (cents): %v\n", priceCents)
+	if err != nil {
+		return 0, err
+	}
 
-				invoiceGroups[configIdx].Invoices[sourceIdx].Value = priceCents
-				invoiceGroups[configIdx].Invoices[sourceIdx].FileName = source.BillName + ".pdf"
-				invoiceGroups[configIdx].Invoices[sourceIdx].FileContents = attachmentBytes
+	return signed(centsValue, negative), nil
+}
 
-				break
-			}
+// Converts an amount into minor units with the given number of decimals,
+// detecting its format: "." and "," are grouping separators when they
+// appear more than once, when another one follows them, or when they're
+// followed by exactly three digits in a currency without three decimals,
+// and the decimal separator otherwise. Spaces always group thousands. E.g.
+// "1.234,56", "1,234.56", "1 234,56" and "1234.5" are all understood.
+// Credits are negative, see cutSign.
+func parseAmount(amount string, decimalDigits int) (int64, error) {
+	unsigned, negative := cutSign(amount)
+	number := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, unsigned)
+
+	units, decimals := number, ""
+	if last := strings.LastIndexAny(number, ".,"); last >= 0 {
+		separator := number[last : last+1]
+		digits := number[last+1:]
+		grouping := strings.Count(number, separator) > 1 ||
+			(len(digits) == 3 && decimalDigits != 3 && !strings.ContainsAny(number[:last], ".,"))
+
+		if !grouping {
+			units, decimals = number[:last], digits
 		}
 	}
+	units = strings.NewReplacer(".", "", ",", "").Replace(units)
 
-	return invoiceGroups
-}
+	if units == "" || strings.Trim(units+decimals, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	if len(decimals) > decimalDigits {
+		return 0, fmt.Errorf("too many decimal digits in %q", amount)
+	}
 
-// Saves invoices to google drive
-func saveInvoices(client *http.Client, month time.Time, invoiceGroups []InvoiceGroup) {
-	ctx := context.Background()
+	value, err := strconv.ParseInt(units+decimals+strings.Repeat("0", decimalDigits-len(decimals)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
 
-	driveService, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	return signed(value, negative), nil
+}
 
+// Compiles a price regex, which must have a named capture group `amount`
+func compilePriceRegex(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
 	if err != nil {
-		log.Fatalf("Unable to retrieve Drive client: %v", err)
+		return nil, err
 	}
 
-	for _, invoiceGroup := range invoiceGroups {
-		var folderMetadata *drive.File = nil
-		for invoiceIdx, invoice := range invoiceGroup.Invoices {
+	if re.SubexpIndex("amount") < 0 {
+		return nil, errors.New("missing named capture group \"amount\"")
+	}
 
-			if invoiceIdx == 0 {
-				folderMetadata = &drive.File{
-					Name:     fmt.Sprintf("%d_%d", month.Year(), month.Month()),
-					MimeType: "application/vnd.google-apps.folder",
-					Parents:  []string{invoiceGroup.DriveDestination},
-				}
+	return re, nil
+}
 
-				query := fmt.Sprintf(
-					`mimeType='application/vnd.google-apps.folder' and
-					'%s' in parents and name = '%s' and trashed = false`,
-					invoiceGroup.DriveDestination,
-					folderMetadata.Name,
-				)
+// Finds and extracts a price value in the `haystack` using the `amount`
+// named capture group of the regex `pattern`.
+func extractPriceWithRegex(haystack string, pattern string, format numberFormat) (int64, error) {
+	re, err := compilePriceRegex(pattern)
+	if err != nil {
+		return 0, err
+	}
+
+	match := re.FindStringSubmatch(haystack)
+	if match == nil {
+		return 0, errors.New("price regex did not match")
+	}
+
+	return parseCents(match[re.SubexpIndex("amount")], format)
+}
+
+// Extracts all the textual content of a html page and returns it as a string,
+// one line per text node. With a cellSeparator, the cells of a table row
+// are joined by it on a single line instead, like "Total | €12,34".
+func extractTextFromHtml(input string, cellSeparator string) string {
+	builder := strings.Builder{}
+	domDocTest := html.NewTokenizer(strings.NewReader(input))
+	previousStartTokenTest := domDocTest.Token()
+
+	// Texts of the cells of the current table row, nil outside rows
+	var rowCells []string
+	inRow := false
+loopDomTest:
+	for {
+		tt := domDocTest.Next()
+		switch {
+		case tt == html.ErrorToken:
+			break loopDomTest // End of the document,  done
+		case tt == html.StartTagToken:
+			previousStartTokenTest = domDocTest.Token()
+			if cellSeparator == "" {
+				continue
+			}
+			switch previousStartTokenTest.Data {
+			case "tr":
+				inRow = true
+				rowCells = nil
+			case "td", "th":
+				if inRow {
+					rowCells = append(rowCells, "")
+				}
+			}
+		case tt == html.EndTagToken:
+			if cellSeparator == "" || domDocTest.Token().Data != "tr" || !inRow {
+				continue
+			}
+			row := strings.Join(slices.DeleteFunc(rowCells, func(cell string) bool { return cell == "" }), cellSeparator)
+			if len(row) > 0 {
+				builder.WriteString(row + "\n")
+			}
+			inRow = false
+			rowCells = nil
+		case tt == html.TextToken:
+			if previousStartTokenTest.Data == "script" || previousStartTokenTest.Data == "style" {
+				continue
+			}
+			TxtContent := strings.TrimSpace(html.UnescapeString(string(domDocTest.Text())))
+			if len(TxtContent) == 0 {
+				continue
+			}
+			if inRow && len(rowCells) > 0 {
+				// Texts of the same cell, e.g. split by <b>, share its line
+				last := len(rowCells) - 1
+				rowCells[last] = strings.TrimSpace(rowCells[last] + " " + TxtContent)
+				continue
+			}
+			builder.WriteString(TxtContent + "\n")
+		}
+	}
+	return builder.String()
+}
+
+// Returns the value of an invoice file saved by a previous run, if any
+type savedInvoiceFunc func(invoiceGroup InvoiceGroup, fileName string, billName string) (int64, bool)
+
+// How invoices are scraped, besides the month and configuration
+type scrapeOptions struct {
+	// Directory attachments are decoded into files in, instead of being
+	// kept in memory, when set
+	AttachmentDir string
+
+	// Number of sources scraped at the same time
+	Concurrency int
+
+	// Reports invoices already saved, which are not fetched again. May be nil.
+	Saved savedInvoiceFunc
+
+	// Only messages received after this time are considered, when set
+	Since time.Time
+
+	// Timezone months start and end in, time.Local when nil
+	Location *time.Location
+
+	// Directory fetched attachments are cached in, not cached when empty
+	CacheDir string
+
+	// Writes the text of every matching message here instead of extracting
+	// prices, when set. No invoices are returned then.
+	DumpText io.Writer
+}
+
+// Scrapes the email inbox for invoices and returns them.
+// Each group is scraped from the inbox of its account, from accountClients.
+// A source that fails doesn't stop the others, its error is recorded in
+// the invoice ProcessingError instead.
+func scrapeEmailInvoices(ctx context.Context, accountClients map[string]*http.Client, month time.Time, configs []SourceConfig, scrape scrapeOptions) ([]InvoiceGroup, error) {
+	accountMessages := map[string]messageLister{}
+	for _, config := range configs {
+		if _, ok := accountMessages[config.Account]; ok {
+			continue
+		}
+
+		client, ok := accountClients[config.Account]
+		if !ok {
+			return nil, fmt.Errorf("account %q is not authenticated", config.Account)
+		}
+
+		srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve Gmail client: %w", err)
+		}
+		accountMessages[config.Account] = gmailMessages{srv: srv}
+	}
+
+	return scrapeInvoiceGroups(ctx, accountMessages, month, configs, scrape), nil
+}
+
+// Scrapes the invoices of every group from the messages of its account,
+// see scrapeEmailInvoices
+func scrapeInvoiceGroups(ctx context.Context, accountMessages map[string]messageLister, month time.Time, configs []SourceConfig, scrape scrapeOptions) []InvoiceGroup {
+	invoiceGroups := make([]InvoiceGroup, len(configs))
+	sourceInvoices := make([][][]Invoice, len(configs))
+
+	// Sources are scraped concurrently, each one into its own slot
+	var workers errgroup.Group
+	workers.SetLimit(max(scrape.Concurrency, 1))
+
+	for configIdx, config := range configs {
+		invoiceGroups[configIdx].Name = config.Name
+		invoiceGroups[configIdx].DriveDestination = config.DriveDestination
+		invoiceGroups[configIdx].FolderDescriptionTemplate = config.FolderDescriptionTemplate
+		invoiceGroups[configIdx].Currency = config.Currency
+		invoiceGroups[configIdx].HomeCurrency = config.HomeCurrency
+		invoiceGroups[configIdx].ExchangeRates = config.ExchangeRates
+		invoiceGroups[configIdx].FolderNameFormat = config.FolderNameFormat
+		invoiceGroups[configIdx].SharedDrive = config.SharedDrive
+		messages := accountMessages[config.Account]
+
+		// A source can have several invoices with SplitByPage, so they are
+		// only flattened into the group once every source is done
+		sourceInvoices[configIdx] = make([][]Invoice, len(config.Sources))
+		for sourceIdx, source := range config.Sources {
+			invoiceGroup := invoiceGroups[configIdx]
+
+			workers.Go(func() error {
+				var savedValue func(fileName string) (int64, bool)
+				if scrape.Saved != nil {
+					savedValue = func(fileName string) (int64, bool) {
+						return scrape.Saved(invoiceGroup, fileName, source.BillName)
+					}
+				}
+
+				// Amounts are parsed with the decimals of the source's currency
+				scraped := source
+				scraped.Currency = cmp.Or(source.Currency, invoiceGroup.currency())
+
+				invoices, err := scrapeSourceInvoice(ctx, messages, month, scraped, scrape, savedValue)
+
+				if err != nil {
+					slog.Error("Unable to process invoice", "bill", source.BillName, "error", err)
+					invoices = []Invoice{{
+						BillName:        source.BillName,
+						ProcessingError: err.Error(),
+					}}
+				}
+				for idx := range invoices {
+					invoices[idx].Currency = source.Currency
+					invoices[idx].Account = config.Account
+				}
+
+				sourceInvoices[configIdx][sourceIdx] = invoices
+				return nil
+			})
+		}
+	}
+
+	workers.Wait()
+
+	for configIdx, config := range configs {
+		for sourceIdx, invoices := range sourceInvoices[configIdx] {
+			for _, invoice := range invoices {
+				// Extractions may be saved in another group
+				groupIdx := configIdx
+				if group := config.Sources[sourceIdx].extractionGroup(invoice.Extraction); group != "" {
+					if idx := slices.IndexFunc(configs, func(c SourceConfig) bool { return c.Name == group }); idx >= 0 {
+						groupIdx = idx
+					}
+				}
+				invoiceGroups[groupIdx].Invoices = append(invoiceGroups[groupIdx].Invoices, invoice)
+			}
+		}
+	}
+
+	return invoiceGroups
+}
+
+// Lists the messages matching the query, following every results page
+func listMessages(ctx context.Context, messages messageLister, query string) ([]*gmail.Message, error) {
+	var msgs []*gmail.Message
+	pageToken := ""
+
+	for {
+		var resp *gmail.ListMessagesResponse
+		err := withRetry(ctx, func() (err error) {
+			resp, err = messages.ListMessages(ctx, query, pageToken)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, resp.Messages...)
+
+		if resp.NextPageToken == "" {
+			return msgs, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// Extracts the text searched for the price from the given location
+func extractInvoiceText(location string, source Source, bodyPart *gmail.MessagePart, attachmentPart *gmail.MessagePart, attachmentBytes []byte, attachmentFile string) (string, error) {
+	switch location {
+	case "body":
+		if bodyPart == nil {
+			return "", errors.New("unable to find body part")
+		}
+		decodedBody, err := decodeBase64(bodyPart.Body.Data)
+
+		if err != nil {
+			return "", fmt.Errorf("unable to decode body: %w", err)
+		}
+		decodedBodyString := string(decodedBody)
+
+		if bodyPart.MimeType == "text/plain" {
+			return decodedBodyString, nil
+		}
+		return extractTextFromHtml(decodedBodyString, source.TableCellSeparator), nil
+	case "attachment":
+		contents, err := openAttachment(attachmentBytes, attachmentFile)
+
+		if err != nil {
+			return "", fmt.Errorf("unable to open attachment: %w", err)
+		}
+		defer contents.Close()
+
+		var invoiceText string
+		if isImageAttachment(attachmentPart.MimeType, attachmentPart.Filename) {
+			invoiceText, err = extractImageText(contents, source.OCRCommand)
+		} else {
+			var password string
+			password, err = source.pdfPassword()
+			if err != nil {
+				return "", err
+			}
+
+			// The page is picked by the delimiters of the first value
+			delimiters := source
+			if len(source.Extractions) > 0 {
+				delimiters = source.withExtraction(source.Extractions[0])
+			}
+
+			invoiceText, err = extractPDFText(
+				contents,
+				source.PageRange,
+				password,
+				source.PDFLayout,
+				delimiters.StringBeforePrice,
+				delimiters.StringAfterPrice,
+			)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("unable to extract page content: %w", err)
+		}
+		return invoiceText, nil
+	default:
+		return "", fmt.Errorf("unknown location %q", location)
+	}
+}
+
+// Collapses every run of whitespace, line breaks included, into a single
+// space when the source sets CollapseWhitespace
+func (s Source) normalizeText(text string) string {
+	if !s.CollapseWhitespace {
+		return text
+	}
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// Collapses a price delimiter like normalizeText. Delimiters made only of
+// whitespace, like "\n", become a single space rather than nothing.
+func (s Source) normalizeDelimiter(delimiter string) string {
+	normalized := s.normalizeText(delimiter)
+	if normalized == "" && delimiter != "" {
+		return " "
+	}
+	return normalized
+}
+
+// Extracts the price in cents from the invoice text with the source's parser.
+// With CollapseWhitespace, the delimiters are collapsed like the text.
+func extractPrice(invoiceText string, source Source) (int64, error) {
+	source.StringBeforePrice = source.normalizeDelimiter(source.StringBeforePrice)
+	source.StringAfterPrice = source.normalizeDelimiter(source.StringAfterPrice)
+
+	switch {
+	case source.PriceRegex != "":
+		return extractPriceWithRegex(invoiceText, source.PriceRegex, source.numberFormat())
+	case source.Parser == "words":
+		return extractPriceInWords(
+			invoiceText,
+			source.StringBeforePrice,
+			source.ParserLanguage,
+			minorUnits(source.currency()),
+		)
+	default:
+		return extractPriceBetweenTwoStrings(
+			invoiceText,
+			source.StringBeforePrice,
+			source.StringAfterPrice,
+			source.Occurrence,
+			source.numberFormat(),
+		)
+	}
+}
+
+// Walks the MIME tree of a message, however deeply multipart parts are
+// nested, and returns its body and the largest attachment whose file name
+// contains attachmentNameContains (see attachmentFilename for attachments
+// without one). The body is the first text/html part,
+// or the first text/plain one for messages without html.
+func findMessageParts(payload *gmail.MessagePart, attachmentNameContains string) (*gmail.MessagePart, *gmail.MessagePart) {
+	var bodyPart *gmail.MessagePart
+	var plainBodyPart *gmail.MessagePart
+	var attachmentPart *gmail.MessagePart
+
+	var walk func(part *gmail.MessagePart)
+	walk = func(part *gmail.MessagePart) {
+		if part == nil {
+			return
+		}
+
+		if bodyPart == nil && part.MimeType == "text/html" {
+			bodyPart = part
+		} else if plainBodyPart == nil && part.MimeType == "text/plain" && part.Filename == "" {
+			plainBodyPart = part
+		} else if filename := attachmentFilename(part); filename != "" && strings.Contains(filename, attachmentNameContains) {
+			// Prefer the largest of several matching attachments
+			if attachmentPart == nil || part.Body.Size > attachmentPart.Body.Size {
+				attachmentPart = part
+				if part.Filename == "" {
+					named := *part
+					named.Filename = filename
+					attachmentPart = &named
+				}
+			}
+		}
+
+		for _, child := range part.Parts {
+			walk(child)
+		}
+	}
+	walk(payload)
+
+	if bodyPart == nil {
+		bodyPart = plainBodyPart
+	}
+
+	return bodyPart, attachmentPart
+}
+
+// Applies the source's ValueExpression and bounds to an extracted value in
+// cents, returning the final value and a warning for zero values
+func applyValueRules(source Source, billName string, priceCents int64) (int64, string, error) {
+	var err error
+	if source.ValueExpression != "" {
+		priceCents, err = evaluateValueExpression(source.ValueExpression, priceCents)
+
+		if err != nil {
+			return 0, "", fmt.Errorf("unable to apply value expression: %w", err)
+		}
+	}
+
+	if (source.MinValue != 0 && priceCents < source.MinValue) || (source.MaxValue != 0 && priceCents > source.MaxValue) {
+		return 0, "", fmt.Errorf("value %s is out of the expected range", formatAmount(priceCents, source.currency()))
+	}
+
+	slog.Info("Extracted price", "bill", billName, "cents", priceCents)
+
+	var warning string
+	if priceCents == 0 {
+		warning = "value is zero"
+		slog.Warn("Extracted a zero value", "bill", billName)
+	}
+
+	return priceCents, warning, nil
+}
+
+// Formats a time for the after: and before: Gmail search operators as
+// seconds since the epoch, since dates are taken in the account's timezone
+func gmailTime(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// Builds the Gmail search query of a source's emails received between after
+// and before. Emails are filtered as much as possible by Gmail, so fewer of
+// them are fetched; subjects are still checked after fetching, since Gmail
+// matches them loosely. A source's QueryOverride replaces all but the dates.
+func gmailQuery(source Source, after string, before string) string {
+	if source.QueryOverride != "" {
+		return fmt.Sprintf("after:%s before:%s %s", after, before, source.QueryOverride)
+	}
+
+	query := fmt.Sprintf("after:%s before:%s %s", after, before, source.From.query())
+
+	// Messages without attachments are never invoices, unless their body is saved
+	if !source.SaveBodyAsPDF {
+		query += " has:attachment"
+	}
+
+	// Gmail has no way to escape quotes inside a quoted term
+	if source.SubjectContains != "" {
+		query += fmt.Sprintf(` subject:"%s"`, strings.ReplaceAll(source.SubjectContains, `"`, ""))
+	}
+	if source.Label != "" {
+		query += fmt.Sprintf(` label:"%s"`, strings.ReplaceAll(source.Label, `"`, ""))
+	}
+
+	return query
+}
+
+// Scrapes the email inbox for the invoice of a single source, or the
+// invoices of each page with SplitByPage.
+// Returns no invoice if none is expected or found this month.
+// When savedValue knows the invoice file, the inbox isn't searched at all.
+func scrapeSourceInvoice(ctx context.Context, messages messageLister, month time.Time, source Source, scrape scrapeOptions, savedValue func(fileName string) (int64, bool)) ([]Invoice, error) {
+	billingMonth, err := source.isBillingMonth(month)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cadence: %w", err)
+	}
+	if !billingMonth {
+		slog.Info("No invoice expected this month", "bill", source.BillName, "cadence", source.Cadence)
+		return nil, nil
+	}
+
+	// Only pdf invoices are known before fetching the attachment, scanned
+	// images, split pdfs and names with the email date are always fetched again
+	fileName := renderFileName(source.FileNameTemplate, source.BillName, month, time.Time{}, "")
+	if savedValue != nil && !source.SplitByPage && len(source.Extractions) == 0 && !fileNameNeedsEmail(source.FileNameTemplate) {
+		value, ok := savedValue(fileName)
+		if ok {
+			slog.Info("Invoice already saved, skipping", "file", fileName)
+			return []Invoice{{
+				BillName:     source.BillName,
+				FileName:     fileName,
+				Value:        value,
+				AlreadySaved: true,
+			}}, nil
+		}
+	}
+
+	windowStart, windowEnd := source.scrapeWindow(month, scrape.Location)
+	if scrape.Since.After(windowStart) {
+		windowStart = scrape.Since
+	}
+
+	msgs, err := listMessages(ctx, messages, gmailQuery(source, gmailTime(windowStart), gmailTime(windowEnd)))
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve messages: %w", err)
+	}
+	if len(msgs) == 0 {
+		slog.Debug("No messages found", "bill", source.BillName)
+	}
+
+	msgs, err = orderMessages(ctx, messages, msgs, source)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range msgs {
+		// Listed messages only have their id
+		if msg.Payload == nil {
+			msg, err = getMessage(ctx, messages, msg.Id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		internalDate := time.UnixMilli(msg.InternalDate)
+
+		// Gmail rounds the window to whole seconds
+		if internalDate.Before(windowStart.Truncate(time.Second)) || !internalDate.Before(windowEnd) {
+			slog.Debug("Message outside of time range, skipping", "bill", source.BillName, "date", internalDate)
+			continue
+		}
+
+		// Find subject
+		var subjectHeader *gmail.MessagePartHeader
+		for _, h := range msg.Payload.Headers {
+
+			if h.Name != "Subject" {
+				continue
+			}
+
+			if !strings.Contains(h.Value, source.SubjectContains) {
+				continue
+			}
+
+			subjectHeader = h
+			break
+		}
+
+		if subjectHeader == nil {
+			continue
+		}
+
+		slog.Debug("Message found", "subject", subjectHeader.Value, "date", internalDate)
+
+		// Find body and attachment
+		bodyPart, attachmentPart := findMessageParts(msg.Payload, source.AttachmentNameContains)
+
+		var attachmentBytes []byte
+		var attachmentFile string
+		var attachmentSize int
+
+		switch {
+		case attachmentPart != nil:
+			slog.Debug("Attachment found", "attachment", attachmentPart.Filename)
+
+			attachmentBytes, attachmentFile, attachmentSize, err = fetchAttachment(ctx, messages, msg.Id, attachmentPart, scrape.AttachmentDir, scrape.CacheDir)
+			if err != nil {
+				return nil, err
+			}
+		case source.SaveBodyAsPDF && bodyPart != nil:
+			slog.Debug("No attachment found, saving the body as pdf", "subject", subjectHeader.Value)
+
+			attachmentBytes, err = renderBodyPDF(bodyPart)
+			if err != nil {
+				return nil, fmt.Errorf("unable to save body as pdf: %w", err)
+			}
+			attachmentSize = len(attachmentBytes)
+
+			// The rendered body stands in for the attachment from now on
+			attachmentPart = &gmail.MessagePart{Filename: bodyPDFName, MimeType: "application/pdf"}
+		default:
+			slog.Debug("No attachment found", "subject", subjectHeader.Value)
+			continue
+		}
+
+		if scrape.DumpText != nil {
+			dumpMessageText(scrape.DumpText, msg, subjectHeader.Value, source, bodyPart, attachmentPart, attachmentBytes, attachmentFile)
+			continue
+		}
+
+		if source.SplitByPage {
+			invoices, err := splitInvoicePages(source, month, internalDate, attachmentPart.Filename, attachmentBytes, attachmentFile, scrape.AttachmentDir)
+			if err != nil {
+				return nil, err
+			}
+
+			for idx := range invoices {
+				invoices[idx].AttachmentName = attachmentPart.Filename
+				invoices[idx].MessageId = msg.Id
+			}
+			return invoices, nil
+		}
+
+		// Try each location in order until one has the price
+		var prices []int64
+		var billingPeriod time.Time
+		var priceErr error
+		textRead := false
+		anchorFound := false
+		for _, location := range source.Location {
+			invoiceText, err := extractInvoiceText(
+				location,
+				source,
+				bodyPart,
+				attachmentPart,
+				attachmentBytes,
+				attachmentFile,
+			)
+			if err != nil {
+				priceErr = err
+				slog.Debug("Unable to extract text", "bill", source.BillName, "location", location, "error", err)
+				continue
+			}
+
+			textRead = true
+			invoiceText = source.normalizeText(invoiceText)
+			slog.Debug("Invoice text", "bill", source.BillName, "location", location, "text", invoiceText)
+
+			if source.RequireAnchor != "" && !strings.Contains(invoiceText, source.normalizeText(source.RequireAnchor)) {
+				slog.Debug("Anchor not found", "bill", source.BillName, "location", location, "anchor", source.RequireAnchor)
+				continue
+			}
+			anchorFound = true
+
+			prices, err = extractPrices(invoiceText, source)
+			if err != nil {
+				priceErr = fmt.Errorf("unable to extract price: %w", err)
+				slog.Debug("Unable to extract price", "bill", source.BillName, "location", location, "error", err)
+				continue
+			}
+
+			billingPeriod = source.billingPeriod(invoiceText)
+			priceErr = nil
+			break
+		}
+
+		// Locations that couldn't be read don't keep a message whose readable
+		// ones lack the anchor, their error only matters when none was read
+		if !anchorFound && (textRead || priceErr == nil) {
+			slog.Warn("Anchor not found, skipping message", "bill", source.BillName, "anchor", source.RequireAnchor)
+			continue
+		}
+
+		if priceErr != nil {
+			return nil, priceErr
+		}
+
+		fileName = renderFileName(source.FileNameTemplate, source.BillName, month, internalDate, attachmentPart.Filename)
+
+		// Scanned invoices keep their image extension
+		if isImageAttachment(attachmentPart.MimeType, attachmentPart.Filename) {
+			fileName = withExtension(fileName, strings.ToLower(filepath.Ext(attachmentPart.Filename)))
+		}
+
+		var invoices []Invoice
+		for idx, priceCents := range prices {
+			billName := source.BillName
+			extractionName := ""
+			if len(source.Extractions) > 0 {
+				billName = extractionBillName(source.BillName, source.Extractions[idx])
+				extractionName = source.Extractions[idx].Name
+			}
+
+			priceCents, warning, err := applyValueRules(source, billName, priceCents)
+			if err != nil {
+				return nil, err
+			}
+
+			invoices = append(invoices, Invoice{
+				BillName:       billName,
+				Value:          priceCents,
+				FileName:       fileName,
+				FileContents:   attachmentBytes,
+				FilePath:       attachmentFile,
+				AttachmentName: attachmentPart.Filename,
+				AttachmentSize: attachmentSize,
+				AttachmentType: attachmentPart.MimeType,
+				BillingPeriod:  billingPeriod,
+				Warning:        warning,
+				MessageId:      msg.Id,
+				Extraction:     extractionName,
+			})
+		}
+
+		return invoices, nil
+	}
+
+	if scrape.DumpText != nil {
+		return nil, nil
+	}
+
+	slog.Warn("Missing invoice", "bill", source.BillName)
+
+	return nil, nil
+}
+
+// Whether a Drive API error means the account can't write to (or even see)
+// the target folder, as opposed to a transient or unexpected failure
+func isDrivePermissionError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	if apiErr.Code == http.StatusNotFound {
+		return true
+	}
+
+	if apiErr.Code != http.StatusForbidden {
+		return false
+	}
+
+	for _, item := range apiErr.Errors {
+		if strings.Contains(strings.ToLower(item.Reason), "ratelimit") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Explains a Drive permission error on the given folder
+func drivePermissionMessage(folderId string) string {
+	return fmt.Sprintf("no write permission to folder %s; ensure it's shared with your account", folderId)
+}
+
+// Looks up the month folder with the given name inside the given Drive
+// folder. Returns an empty id if it doesn't exist.
+func findMonthFolder(ctx context.Context, files fileUploader, parentId string, folderName string) (string, error) {
+	query := fmt.Sprintf(
+		`mimeType='application/vnd.google-apps.folder' and
+		'%s' in parents and name = '%s' and trashed = false`,
+		parentId,
+		folderName,
+	)
+
+	var folders []*drive.File
+	err := withRetry(ctx, func() (err error) {
+		folders, err = files.ListFiles(ctx, query, "files(id, name)")
+		return err
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(folders) == 0 {
+		return "", nil
+	}
+
+	return folders[0].Id, nil
+}
+
+// Records the error on every invoice that hasn't failed yet
+func failInvoices(invoices []Invoice, err error) {
+	for idx := range invoices {
+		if invoices[idx].ProcessingError == "" {
+			invoices[idx].ProcessingError = err.Error()
+		}
+	}
+}
+
+// Saves invoices to google drive.
+// Failures are recorded in the invoices ProcessingError, so the remaining
+// groups and invoices are still saved.
+// With dryRun, only logs what would be created or uploaded.
+// With overwrite, files that already exist are replaced instead of skipped.
+func saveInvoices(ctx context.Context, client *http.Client, month time.Time, invoiceGroups []InvoiceGroup, dryRun bool, overwrite bool) error {
+
+	driveService, err := drive.NewService(ctx, option.WithHTTPClient(client))
+
+	if err != nil {
+		return fmt.Errorf("unable to retrieve Drive client: %w", err)
+	}
+
+	// Groups in Shared Drives need their own calls, the slices share the
+	// invoices so their errors are still recorded
+	for idx, invoiceGroup := range invoiceGroups {
+		files := driveFiles{srv: driveService, sharedDrive: invoiceGroup.SharedDrive}
+		uploadInvoices(ctx, files, month, invoiceGroups[idx:idx+1], dryRun, overwrite)
+	}
+
+	return nil
+}
+
+// Uploads the invoices of every group into its month folder, see saveInvoices.
+// Invoices whose billing period was found go into the folder of that month.
+func uploadInvoices(ctx context.Context, files fileUploader, month time.Time, invoiceGroups []InvoiceGroup, dryRun bool, overwrite bool) {
+	for _, invoiceGroup := range invoiceGroups {
+		// Indexes of the invoices of each folder, by month key
+		var folderMonths []time.Time
+		folderInvoices := map[string][]int{}
+		for invoiceIdx, invoice := range invoiceGroup.Invoices {
+			folderMonth := invoice.folderMonth(month)
+			key := historyKey(folderMonth)
+			if _, ok := folderInvoices[key]; !ok {
+				folderMonths = append(folderMonths, folderMonth)
+			}
+			folderInvoices[key] = append(folderInvoices[key], invoiceIdx)
+		}
+
+		for _, folderMonth := range folderMonths {
+			indexes := folderInvoices[historyKey(folderMonth)]
+
+			folderGroup := invoiceGroup
+			folderGroup.Invoices = nil
+			for _, invoiceIdx := range indexes {
+				folderGroup.Invoices = append(folderGroup.Invoices, invoiceGroup.Invoices[invoiceIdx])
+			}
+
+			uploadFolderInvoices(ctx, files, folderMonth, folderGroup, dryRun, overwrite)
+
+			for idx, invoiceIdx := range indexes {
+				invoiceGroup.Invoices[invoiceIdx].ProcessingError = folderGroup.Invoices[idx].ProcessingError
+				invoiceGroup.Invoices[invoiceIdx].StorageId = folderGroup.Invoices[idx].StorageId
+			}
+		}
+	}
+}
+
+// Finds the month folder of a group, creating it when missing, and keeps its
+// description in sync. Looking the folder up again before every creation
+// attempt keeps retries and re-runs from creating it twice.
+// Returns "" with dryRun when the folder doesn't exist yet.
+func resolveMonthFolder(ctx context.Context, files fileUploader, month time.Time, invoiceGroup InvoiceGroup, dryRun bool) (string, error) {
+	description, err := renderFolderDescription(invoiceGroup, month)
+	if err != nil {
+		return "", fmt.Errorf("unable to render folder description: %w", err)
+	}
+
+	folderMetadata := &drive.File{
+		Name:        monthFolderName(month, invoiceGroup.FolderNameFormat),
+		MimeType:    "application/vnd.google-apps.folder",
+		Parents:     []string{invoiceGroup.DriveDestination},
+		Description: description,
+	}
+
+	folderId, err := findMonthFolder(ctx, files, invoiceGroup.DriveDestination, folderMetadata.Name)
+	if err != nil {
+		return "", fmt.Errorf("unable to list files: %w", err)
+	}
+
+	if folderId != "" {
+		// Keep the description in sync with the latest total
+		if description != "" && !dryRun {
+			_, err = files.UpdateFile(
+				ctx,
+				folderId,
+				&drive.File{Description: description},
+				nil,
+			)
+
+			if err != nil {
+				slog.Warn("Unable to update folder description", "folder", folderId, "error", err)
+			}
+		}
+		return folderId, nil
+	}
+
+	if dryRun {
+		slog.Info("Would create folder", "folder", folderMetadata.Name)
+		return "", nil
+	}
+
+	err = withRetry(ctx, func() error {
+		// A failed attempt may still have created the folder
+		folderId, err = findMonthFolder(ctx, files, invoiceGroup.DriveDestination, folderMetadata.Name)
+		if err != nil || folderId != "" {
+			return err
+		}
+
+		created, err := files.CreateFile(ctx, folderMetadata, nil)
+		if err == nil {
+			folderId = created.Id
+		}
+		return err
+	})
+
+	if isDrivePermissionError(err) {
+		slog.Error(drivePermissionMessage(invoiceGroup.DriveDestination))
+		return "", errors.New(drivePermissionMessage(invoiceGroup.DriveDestination))
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to create folder: %w", err)
+	}
+
+	return folderId, nil
+}
+
+// Uploads the invoices of a group into the folder of the given month
+func uploadFolderInvoices(ctx context.Context, files fileUploader, month time.Time, invoiceGroup InvoiceGroup, dryRun bool, overwrite bool) {
+	if len(invoiceGroup.Invoices) == 0 {
+		return
+	}
+
+	folderId, err := resolveMonthFolder(ctx, files, month, invoiceGroup, dryRun)
+	if err != nil {
+		failInvoices(invoiceGroup.Invoices, err)
+		return
+	}
+
+	if folderId == "" {
+		for _, invoice := range invoiceGroup.Invoices {
+			if invoice.FileName != "" && invoice.ProcessingError == "" {
+				slog.Info("Would upload file", "file", invoice.FileName)
+			}
+		}
+		return
+	}
+
+	// Files shared by several invoices are uploaded once, ids by file name
+	uploaded := map[string]string{}
+
+	for invoiceIdx, invoice := range invoiceGroup.Invoices {
+		if invoice.FileName == "" || invoice.ProcessingError != "" || invoice.AlreadySaved {
+			continue
+		}
+		if fileId, ok := uploaded[invoice.FileName]; ok {
+			invoiceGroup.Invoices[invoiceIdx].StorageId = fileId
+			continue
+		}
+
+		fileMetadata := &drive.File{
+			Name:     invoice.FileName,
+			MimeType: invoice.contentType(),
+			Parents: []string{
+				folderId,
+			},
+			AppProperties: map[string]string{
+				"value":    strconv.FormatInt(fileValue(invoiceGroup.Invoices, invoice.FileName), 10),
+				"currency": invoiceGroup.currency(),
+			},
+		}
+
+		query := fmt.Sprintf(
+			"'%s' in parents and name = '%s' and trashed = false",
+			folderId,
+			fileMetadata.Name,
+		)
+
+		var existing []*drive.File
+		err := withRetry(ctx, func() (err error) {
+			existing, err = files.ListFiles(ctx, query, "files(id, name)")
+			return err
+		})
+
+		if err != nil {
+			invoiceGroup.Invoices[invoiceIdx].ProcessingError = fmt.Sprintf("unable to list files: %v", err)
+			continue
+		}
+
+		existingId := ""
+		if len(existing) > 0 {
+			if !overwrite {
+				slog.Info("File already exists", "file", invoice.FileName)
+				continue
+			}
+			existingId = existing[0].Id
+		}
+
+		if dryRun {
+			if existingId != "" {
+				slog.Info("Would overwrite file", "file", invoice.FileName)
+			} else {
+				slog.Info("Would upload file", "file", invoice.FileName)
+			}
+			continue
+		}
+
+		if existingId != "" {
+			slog.Info("Overwriting file", "file", invoice.FileName)
+		} else {
+			slog.Info("Uploading file", "file", invoice.FileName)
+		}
+
+		// Each attempt uploads the file from the start
+		var openErr error
+		fileId := existingId
+		err = withRetry(ctx, func() error {
+			contents, err := invoice.Open()
+			if err != nil {
+				openErr = err
+				return nil
+			}
+			defer contents.Close()
+
+			if existingId != "" {
+				// Parents can't be set on update, the file stays in place
+				_, err = files.UpdateFile(
+					ctx,
+					existingId,
+					&drive.File{
+						MimeType:      fileMetadata.MimeType,
+						AppProperties: fileMetadata.AppProperties,
+					},
+					contents,
+				)
+				return err
+			}
+
+			created, err := files.CreateFile(ctx, fileMetadata, contents)
+			if err == nil {
+				fileId = created.Id
+			}
+			return err
+		})
+
+		if openErr != nil {
+			invoiceGroup.Invoices[invoiceIdx].ProcessingError = fmt.Sprintf("unable to open invoice file: %v", openErr)
+			continue
+		}
+
+		if isDrivePermissionError(err) {
+			slog.Error(drivePermissionMessage(folderId))
+			failInvoices(invoiceGroup.Invoices[invoiceIdx:], errors.New(drivePermissionMessage(folderId)))
+			return
+		}
+
+		if err != nil {
+			invoiceGroup.Invoices[invoiceIdx].ProcessingError = fmt.Sprintf("unable to create file: %v", err)
+			continue
+		}
+
+		invoiceGroup.Invoices[invoiceIdx].StorageId = fileId
+		uploaded[invoice.FileName] = fileId
+	}
+}
+
+// Total value of the invoices saved in a file, which is shared by the
+// invoices of a source with Extractions and holds a single value otherwise
+func fileValue(invoices []Invoice, fileName string) int64 {
+	var total int64
+	for _, invoice := range invoices {
+		if invoice.FileName == fileName {
+			total += invoice.Value
+		}
+	}
+	return total
+}
+
+func readConfiguration(path string) []SourceConfig {
+	var configs []SourceConfig
+
+	configBytes, err := readFileOrEnv(path, configEnv)
+
+	if err != nil {
+		log.Fatalf("Unable to read config file: %v", err)
+	}
+
+	// EIM_CONFIG may hold either format, and JSON is also valid YAML
+	_, statErr := os.Stat(path)
+	fromEnv := errors.Is(statErr, os.ErrNotExist)
+
+	switch ext := strings.ToLower(filepath.Ext(path)); {
+	case fromEnv, ext == ".yaml", ext == ".yml":
+		err = yaml.Unmarshal(configBytes, &configs)
+	default:
+		err = json.Unmarshal(configBytes, &configs)
+	}
+
+	if err != nil {
+		log.Fatalf("Unable to parse config file: %v", err)
+	}
+
+	return configs
+}
+
+// Permissions requested from the google account, shared by every command so
+// they can all reuse the same token
+var googleScopes = []string{
+	drive.DriveFileScope,
+	gmail.GmailModifyScope,
+	gmail.GmailSendScope,
+	sheets.SpreadsheetsScope,
+}
+
+// How to get a google OAuth client secret file, printed when it's missing
+// or can't be parsed
+const credentialsSetupGuide = `To create a client secret file:
+  1. Open https://console.cloud.google.com and create (or pick) a project.
+  2. In "APIs & Services" > "Library", enable the Gmail API, the Google
+     Drive API and the Google Sheets API.
+  3. In "APIs & Services" > "OAuth consent screen", configure the consent
+     screen and add your Google account as a test user.
+  4. In "APIs & Services" > "Credentials", click "Create credentials" >
+     "OAuth client ID" and pick the "Desktop app" application type.
+  5. Download the client secret JSON and save it as %s
+     (or point -credentials to it).
+  6. Run "email-invoice-manager auth" to authorize the tool.
+`
+
+// Prints what's wrong with the client secret file and how to get one, then
+// exits with a non-zero code
+func exitWithCredentialsGuide(problem string, credentialsPath string) {
+	fmt.Fprintf(os.Stderr, "%s\n\n", problem)
+	fmt.Fprintf(os.Stderr, credentialsSetupGuide, credentialsPath)
+	os.Exit(1)
+}
+
+// Reads the google OAuth client secret file
+func loadGoogleOAuthConfig(credentialsPath string) *oauth2.Config {
+	b, err := readFileOrEnv(credentialsPath, credentialsEnv)
+	if errors.Is(err, os.ErrNotExist) {
+		exitWithCredentialsGuide(
+			fmt.Sprintf("The google OAuth client secret file %s doesn't exist and %s is not set.", credentialsPath, credentialsEnv),
+			credentialsPath,
+		)
+	}
+	if err != nil {
+		log.Fatalf("Unable to read client secret file: %v", err)
+	}
+
+	// If modifying these scopes, delete your previously saved token file.
+	config, err := google.ConfigFromJSON(b, googleScopes...)
+	if err != nil {
+		exitWithCredentialsGuide(
+			fmt.Sprintf("The google OAuth client secret file %s is not valid: %v", credentialsPath, err),
+			credentialsPath,
+		)
+	}
+	return config
+}
+
+func loadAuthenticatedGoogleClient(credentialsPath string, tokenPath string) *http.Client {
+	return loadAccountClient(credentialsPath, tokenPath, "")
+}
+
+// Authenticates a Gmail account with its token file, see accountTokenPath,
+// or its token environment variable, see accountTokenEnv
+func loadAccountClient(credentialsPath string, tokenPath string, account string) *http.Client {
+	return getClient(
+		loadGoogleOAuthConfig(credentialsPath),
+		accountTokenPath(tokenPath, account),
+		accountTokenEnv(account),
+	)
+}
+
+// Goes through the authorization flow and saves a new token, even if a
+// valid one exists, e.g. after rotating credentials or adding a scope
+func authenticateGoogle(credentialsPath string, tokenPath string) {
+	tok := getTokenFromWeb(loadGoogleOAuthConfig(credentialsPath))
+	err := saveToken(tokenPath, tok)
+	if err != nil {
+		log.Fatalf("Unable to cache oauth token: %v", err)
+	}
+}
+
+// Returns the environment variable holding the Drive folder of a group
+// without DriveDestination: DRIVE_DEST_ followed by the group name in
+// uppercase, with every character other than letters and digits replaced
+// by "_". E.g. "Bills A" reads DRIVE_DEST_BILLS_A.
+func driveDestinationEnv(groupName string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, groupName)
+
+	return "DRIVE_DEST_" + name
+}
+
+// Fills in empty DriveDestinations from the environment
+func resolveDriveDestinations(configs []SourceConfig) {
+	// Settings may live in .env alongside the notification ones
+	godotenv.Load()
+
+	for idx, config := range configs {
+		if config.DriveDestination == "" {
+			configs[idx].DriveDestination = os.Getenv(driveDestinationEnv(config.Name))
+		}
+	}
+}
 
-				resp, err := driveService.Files.List().
-					Q(query).
-					Fields("files(id, name)").
-					Do()
+// Command line options for a run
+type Options struct {
+	// Path to the configuration file
+	ConfigPath string
 
-				if err != nil {
-					log.Fatalf("Unable to list files: %v", err)
-				}
+	// Timezone months start and end in when searching emails
+	Timezone *time.Location
 
-				if len(resp.Files) > 0 {
-					folderMetadata.Id = resp.Files[0].Id
-				} else {
-					folderMetadata, err = driveService.Files.Create(folderMetadata).Do()
+	// Directory fetched attachments are cached in, empty with -no-cache
+	CacheDir string
 
-					if err != nil {
-						log.Fatalf("Unable to create folder: %v", err)
-					}
-				}
-			}
+	// Don't print the table of invoices at the end of each month
+	Quiet bool
 
-			if folderMetadata == nil {
-				log.Fatalf("unreachable")
-			}
+	// Path to the google OAuth client secret file
+	CredentialsPath string
 
-			fileMetadata := &drive.File{
-				Name: invoice.FileName,
-				Parents: []string{
-					folderMetadata.Id,
-				},
-			}
+	// Path to the file caching the google OAuth token
+	TokenPath string
 
-			query := fmt.Sprintf(
-				"'%s' in parents and name = '%s' and trashed = false",
-				folderMetadata.Id,
-				fileMetadata.Name,
-			)
+	// Path to the local file recording extracted values per month
+	HistoryPath string
 
-			resp, err := driveService.Files.List().
-				Q(query).
-				Fields("files(id, name)").
-				Do()
+	// Optional path of the local index of every uploaded invoice file
+	IndexPath string
 
-			if err != nil {
-				log.Fatalf("Unable to list files: %v", err)
-			}
+	// Warn when an invoice value equals the previous month's value
+	WarnUnchanged bool
 
-			if len(resp.Files) > 0 {
-				log.Printf("File already exists: %s\n", invoice.FileName)
-				continue
-			}
+	// Optional path where the notification message is also written
+	NotifyFile string
+
+	// Optional path of a text/template file the notification message is
+	// rendered with, instead of the built-in format
+	NotifyTemplate string
+
+	// Path of the file keeping the invoices of the last run's notifications,
+	// which the notify command sends again. Empty to not keep them.
+	NotifyStatePath string
+
+	// Where invoices are archived, either "drive" or "s3"
+	Storage string
+
+	// Include the original attachment name and size in the notification
+	AttachmentInfo bool
+
+	// Include a link to each invoice's Gmail message in the notification
+	MessageLinks bool
+
+	// Notifiers to try in order until one delivers the message
+	Notifiers []string
+
+	// Decode attachments into temporary files instead of keeping them in memory
+	StreamToDisk bool
+
+	// Scrape and print everything without uploading, notifying or
+	// recording history
+	DryRun bool
+
+	// Optional path of a Beancount file the invoices are appended to
+	BeancountOut string
+
+	// Number of sources scraped at the same time
+	Concurrency int
+
+	// Path of the CSV or JSON summary of the extracted invoices
+	OutputPath string
+
+	// Deadline of each month of a run (or of each check in watch mode), 0
+	// for none
+	Timeout time.Duration
+
+	// Replace invoice files that were already saved instead of skipping them
+	Overwrite bool
+
+	// Only scrape messages received since the last successful run
+	Incremental bool
+
+	// Whether the months are a -from/-to range, which records its progress
+	Backfill bool
+
+	// Path of the file recording the months of a backfill already completed
+	ProgressPath string
+
+	// Process every month of a backfill, ignoring its recorded progress
+	Force bool
+
+	// Source BillNames or group Names to scrape, all of them when empty
+	Only []string
+
+	// Source BillNames or group Names not to scrape
+	Skip []string
+
+	// Gmail label applied to the messages of scraped invoices, empty for none
+	Label string
+
+	// Path of the node_exporter textfile metrics written after the run
+	MetricsPath string
+
+	// Path of the file recording the time of the last successful run
+	LastRunPath string
+}
+
+// State shared by all the months processed in a run
+type invoiceRun struct {
+	options       Options
+	configs       []SourceConfig
+	history       History
+	googleClient  *http.Client
+	storage       Storage
+	attachmentDir string
+
+	// Clients of every scraped Gmail account, see loadAccountClients
+	accountClients map[string]*http.Client
+
+	// Time of the last successful run in incremental mode
+	since time.Time
+
+	// Rows of the -output summary of all months processed so far
+	summary []summaryRow
+
+	// Failures of single invoices, saving or notifying, which don't stop
+	// the run but are reported once it's done
+	failures []error
+
+	// Metrics of all months processed so far, for -metrics-file
+	metrics runMetrics
+
+	// Template of the notification message, from -notify-template, nil for
+	// the built-in format
+	notifyTemplate *template.Template
+
+	// Invoices of all months notified about so far, for -notify-state
+	notified []notificationState
+}
+
+// Reported when the run finished but some invoices failed, so scheduled
+// runs can tell it apart from a run that couldn't start
+var errPartialFailure = errors.New("some invoices failed")
+
+// Exit code of runs ending with errPartialFailure, other failures exit with 1
+const partialFailureExitCode = 2
+
+func invoiceManager(months []time.Time, options Options) error {
+	run := invoiceRun{options: options}
+	startedAt := time.Now()
+
+	run.configs = readConfiguration(options.ConfigPath)
+	history, err := loadHistory(options.HistoryPath)
+	if err != nil {
+		return fmt.Errorf("unable to read history file: %w", err)
+	}
+	run.history = history
+
+	if options.Storage == "drive" {
+		resolveDriveDestinations(run.configs)
+		err = validateConfig(run.configs)
+	} else {
+		err = validateSources(run.configs)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	run.configs, err = filterSources(run.configs, options.Only, options.Skip)
+	if err != nil {
+		return fmt.Errorf("invalid -only or -skip: %w", err)
+	}
+
+	err = checkPDFTools(run.configs)
+	if err != nil {
+		return err
+	}
 
-			log.Printf("Uploading file: %s\n", invoice.FileName)
+	if options.NotifyTemplate != "" {
+		run.notifyTemplate, err = loadNotificationTemplate(options.NotifyTemplate)
+		if err != nil {
+			return fmt.Errorf("unable to read notification template: %w", err)
+		}
+	}
+
+	run.googleClient = loadAuthenticatedGoogleClient(options.CredentialsPath, options.TokenPath)
+	run.accountClients = loadAccountClients(options.CredentialsPath, options.TokenPath, run.configs, run.googleClient)
+	run.storage, err = newStorage(options.Storage, run.googleClient, options.DryRun, options.Overwrite)
+	if err != nil {
+		return fmt.Errorf("unable to configure storage: %w", err)
+	}
+
+	if options.StreamToDisk {
+		run.attachmentDir, err = os.MkdirTemp("", "email-invoice-manager-*")
+		if err != nil {
+			return fmt.Errorf("unable to create temporary directory: %w", err)
+		}
+		defer os.RemoveAll(run.attachmentDir)
+	}
+
+	if options.Incremental {
+		run.since, err = loadLastRun(options.LastRunPath)
+		if err != nil {
+			return fmt.Errorf("unable to read last run file: %w", err)
+		}
+	}
+
+	// Backfills resume from the first month not completed by a previous run.
+	// Progress of partial runs isn't kept, like the incremental last run.
+	resume := options.Backfill && !options.DryRun && len(options.Only) == 0 && len(options.Skip) == 0
+	var progress backfillProgress
+	if resume && !options.Force {
+		progress, err = loadBackfillProgress(options.ProgressPath, months)
+		if err != nil {
+			return fmt.Errorf("unable to read backfill progress file: %w", err)
+		}
+	}
+	progress.Range = backfillRange(months)
+
+	for _, month := range months {
+		if resume && progress.isCompleted(month) {
+			slog.Info("Month already completed by a previous run, skipping", "month", historyKey(month))
+			continue
+		}
 
-			_, err = driveService.Files.Create(fileMetadata).Media(bytes.NewReader(invoice.FileContents)).Do()
+		if len(months) > 1 {
+			slog.Info("Processing month", "month", historyKey(month))
+		}
+
+		failures := len(run.failures)
+		err = run.processMonthWithTimeout(month, options.Timeout)
+		if err != nil {
+			return fmt.Errorf("%s: %w", historyKey(month), err)
+		}
 
+		if resume && len(run.failures) == failures {
+			err = progress.complete(options.ProgressPath, month)
 			if err != nil {
-				log.Fatalf("Unable to create file: %v", err)
+				return fmt.Errorf("unable to save backfill progress file: %w", err)
 			}
 		}
 	}
-}
 
-func readConfiguration() []SourceConfig {
-	var configs []SourceConfig
+	// A finished backfill starts over when run again
+	if resume && len(progress.Completed) == len(months) {
+		err = os.Remove(options.ProgressPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove backfill progress file: %w", err)
+		}
+	}
 
-	configBytes, err := os.ReadFile("configuration.json")
+	if options.MetricsPath != "" {
+		err = writeMetrics(options.MetricsPath, &run.metrics, time.Now())
+		if err != nil {
+			return fmt.Errorf("unable to write metrics file: %w", err)
+		}
+	}
 
-	if err != nil {
-		log.Fatalf("Unable to read config file: %v", err)
+	// The messages of failed invoices must be looked at again next time
+	if len(run.failures) > 0 {
+		return fmt.Errorf("%w:\n%w", errPartialFailure, errors.Join(run.failures...))
 	}
 
-	err = json.Unmarshal(configBytes, &configs)
+	// Messages arriving while this run went on are picked up by the next.
+	// The sources left out by -only and -skip haven't been scraped yet.
+	if options.Incremental && !options.DryRun && len(options.Only) == 0 && len(options.Skip) == 0 {
+		err = saveLastRun(options.LastRunPath, startedAt)
+		if err != nil {
+			return fmt.Errorf("unable to save last run file: %w", err)
+		}
+	}
 
-	if err != nil {
-		log.Fatalf("Unable to parse config file: %v", err)
+	return nil
+}
+
+// Records a failure of the month that doesn't stop the run
+func (run *invoiceRun) fail(month time.Time, err error) {
+	run.failures = append(run.failures, fmt.Errorf("%s: %w", historyKey(month), err))
+}
+
+// Returns a check for invoices saved by a previous run, whose value is
+// then taken from the history instead of scraping the invoice again
+func (run *invoiceRun) savedInvoiceValue(ctx context.Context, month time.Time) savedInvoiceFunc {
+	return func(invoiceGroup InvoiceGroup, fileName string, billName string) (int64, bool) {
+		value, ok := run.history.Lookup(month, invoiceGroup.Name, billName)
+		if !ok {
+			return 0, false
+		}
+
+		exists, err := run.storage.InvoiceExists(ctx, month, invoiceGroup, fileName)
+		if err != nil {
+			slog.Warn("Unable to check whether the invoice was already saved", "file", fileName, "error", err)
+			return 0, false
+		}
+
+		return value, exists
 	}
+}
 
-	return configs
+// Scrapes, saves and notifies about the invoices of a single month
+// Processes a month with a deadline, so a hung API call fails it cleanly
+// without cutting a long backfill short. 0 means no deadline.
+func (run *invoiceRun) processMonthWithTimeout(month time.Time, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return run.processMonth(ctx, month)
 }
 
-// Sends invoice summary through Signal
-func sendNotification(invoiceGroups []InvoiceGroup, dryRun bool) error {
-	err := godotenv.Load()
+func (run *invoiceRun) processMonth(ctx context.Context, month time.Time) error {
+	options := run.options
+
+	// Overwriting needs every invoice fetched again
+	var saved savedInvoiceFunc
+	if !options.Overwrite {
+		saved = run.savedInvoiceValue(ctx, month)
+	}
+
+	invoiceGroups, err := scrapeEmailInvoices(ctx, run.accountClients, month, run.configs, scrapeOptions{
+		AttachmentDir: run.attachmentDir,
+		Concurrency:   options.Concurrency,
+		Saved:         saved,
+		Since:         run.since,
+		Location:      options.Timezone,
+		CacheDir:      options.CacheDir,
+	})
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		return err
+	}
+	// Only the file names and values, the invoices hold the attachment bytes
+	for _, invoiceGroup := range invoiceGroups {
+		var invoices []string
+		for _, invoice := range invoiceGroup.Invoices {
+			invoices = append(invoices, invoice.Summary())
+		}
+		slog.Debug("Scraped invoices", "group", invoiceGroup.Name, "invoices", invoices)
+	}
+
+	if options.OutputPath != "" {
+		run.summary = append(run.summary, summaryRows(month, invoiceGroups)...)
+		err = writeSummary(options.OutputPath, run.summary)
+		if err != nil {
+			return fmt.Errorf("unable to write summary file: %w", err)
+		}
 	}
 
-	phoneNumber := os.Getenv("CALLMEBOT_PHONE_NUMBER")
-	if phoneNumber == "" {
-		return errors.New("CALLMEBOT_PHONE_NUMBER is not set")
+	if options.WarnUnchanged {
+		warnUnchangedValues(run.history, month, invoiceGroups)
 	}
-	apiKey := os.Getenv("CALLMEBOT_API_KEY")
-	if apiKey == "" {
-		return errors.New("CALLMEBOT_API_KEY is not set")
+	if !options.DryRun {
+		run.history.Record(month, invoiceGroups)
+		err = saveHistory(options.HistoryPath, run.history)
+		if err != nil {
+			return fmt.Errorf("unable to save history file: %w", err)
+		}
 	}
 
-	apiUrl := fmt.Sprintf(
-		"https://api.callmebot.com/signal/send.php?phone=%s&apikey=%s&text=",
-		phoneNumber,
-		apiKey,
-	)
+	if options.BeancountOut != "" && !options.DryRun {
+		err = appendLedger(options.BeancountOut, "beancount", month, invoiceGroups, run.configs)
+		if err != nil {
+			return fmt.Errorf("unable to write Beancount file: %w", err)
+		}
+	}
 
-	message := strings.Builder{}
-	for idx, invoiceGroup := range invoiceGroups {
+	if !options.DryRun {
+		err = appendSheetRows(ctx, run.googleClient, month, invoiceGroups, run.configs)
+		if err != nil {
+			return fmt.Errorf("unable to append to sheet: %w", err)
+		}
+	}
+
+	if options.Label != "" && !options.DryRun {
+		err = labelScrapedMessages(ctx, run.accountClients, invoiceGroups, options.Label)
+		if err != nil {
+			slog.Error("Unable to label messages", "error", err)
+		}
+	}
+
+	// Values are still worth notifying about when saving fails
+	err = run.storage.SaveInvoices(ctx, month, invoiceGroups)
+	if err != nil {
+		slog.Error("Unable to save invoices", "error", err)
+		run.fail(month, fmt.Errorf("unable to save invoices: %w", err))
+	}
 
-		if idx > 0 {
-			message.WriteString("\n")
+	if options.IndexPath != "" && !options.DryRun {
+		err = updateIndex(options.IndexPath, month, invoiceGroups, time.Now())
+		if err != nil {
+			slog.Error("Unable to update index file", "error", err)
+			run.fail(month, fmt.Errorf("unable to update index file: %w", err))
 		}
+	}
+
+	run.metrics.add(month, run.configs, invoiceGroups)
 
-		message.WriteString(fmt.Sprintf("%d. %s\n", idx+1, invoiceGroup.Name))
-		var total uint64 = 0
+	for _, invoiceGroup := range invoiceGroups {
 		for _, invoice := range invoiceGroup.Invoices {
-			total += invoice.Value
-			message.WriteString(
-				fmt.Sprintf(
-					"+ %s - %d,%d\n",
-					invoice.FileName,
-					invoice.Value/100,
-					invoice.Value%100,
-				),
-			)
+			if invoice.ProcessingError != "" {
+				run.fail(month, fmt.Errorf("%s / %s: %s", invoiceGroup.Name, invoice.BillName, invoice.ProcessingError))
+			}
 		}
-		message.WriteString(fmt.Sprintf(
-			"Total: %d,%d\n",
-			total/100,
-			total%100,
-		))
 	}
 
-	fmt.Printf("Sending notification:\n")
+	// The built-in message is still sent when the template fails
+	message, err := notificationMessage(invoiceGroups, month, run.history, options.AttachmentInfo, options.MessageLinks, run.notifyTemplate)
+	if err != nil {
+		slog.Error("Unable to render notification template, sending the default message", "error", err)
+		run.fail(month, err)
+	}
 
-	fmt.Println(message.String())
+	if options.NotifyStatePath != "" && !options.DryRun {
+		run.notified = append(run.notified, notificationState{Month: month, InvoiceGroups: invoiceGroups})
+		err = saveNotificationState(options.NotifyStatePath, run.notified)
+		if err != nil {
+			return fmt.Errorf("unable to write notification state: %w", err)
+		}
+	}
 
-	if dryRun {
-		return nil
+	if options.NotifyFile != "" {
+		err = writeNotificationFile(options.NotifyFile, message)
+		if err != nil {
+			return fmt.Errorf("unable to write notification file: %w", err)
+		}
 	}
 
-	resp, err := http.Get(apiUrl + url.QueryEscape(message.String()))
+	err = sendNotification(
+		ctx,
+		options.Notifiers,
+		run.googleClient,
+		fmt.Sprintf("Invoices for %s", historyKey(month)),
+		message,
+		options.DryRun,
+	)
+
+	// The invoices are already saved, so the remaining months still run
 	if err != nil {
-		log.Fatalf("Unable to send notification: %v", err)
+		slog.Error("Unable to send notification", "error", err)
+		run.fail(month, fmt.Errorf("unable to send notification: %w", err))
 	}
 
-	if resp.StatusCode != 200 {
-		log.Fatalf("Unable to send notification: %v", resp.Status)
+	if !options.Quiet {
+		fmt.Printf("\nInvoices for %s:\n", historyKey(month))
+		err = writeInvoiceTable(os.Stdout, month, run.configs, invoiceGroups)
+		if err != nil {
+			return fmt.Errorf("unable to print invoices: %w", err)
+		}
 	}
 
-	defer resp.Body.Close()
-
 	return nil
 }
 
-func loadAuthenticatedGoogleClient(scope ...string) *http.Client {
-	b, err := os.ReadFile("credentials.json")
-	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+// Parses a month in YYYY-MM format, or "now" for the current month
+func parseMonth(month string) (time.Time, error) {
+	if month == "now" {
+		now := time.Now()
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), nil
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, scope...)
+	return time.Parse("2006-01", month)
+}
+
+// Parses a YYYY-MM or YYYY-MM-DD date into the first day of its month
+func parseRangeMonth(date string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", date)
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		t, err = time.Parse("2006-01", date)
 	}
-	return getClient(config)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not in YYYY-MM or YYYY-MM-DD format", date)
+	}
+
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC), nil
 }
 
-func invoiceManager(month time.Time) {
-	configs := readConfiguration()
-	googleClient := loadAuthenticatedGoogleClient(
-		drive.DriveFileScope,
-		gmail.GmailReadonlyScope,
-	)
-	invoiceGroups := scrapeEmailInvoices(googleClient, month, configs)
-	fmt.Printf("invoiceGroups: %v\n", invoiceGroups)
-	saveInvoices(googleClient, month, invoiceGroups)
-	err := sendNotification(invoiceGroups, false)
+// Returns every month between from and to, both included. Dates are
+// rounded down to their month, and to defaults to the current month.
+func monthRange(from string, to string) ([]time.Time, error) {
+	if from == "" {
+		return nil, errors.New("-to requires -from")
+	}
+
+	first, err := parseRangeMonth(from)
+	if err != nil {
+		return nil, err
+	}
 
+	last, err := parseMonth("now")
+	if to != "" {
+		last, err = parseRangeMonth(to)
+	}
 	if err != nil {
-		log.Fatalf("Unable to send notification: %v", err)
+		return nil, err
+	}
+
+	if last.Before(first) {
+		return nil, fmt.Errorf("%s is before %s", to, from)
+	}
+
+	var months []time.Time
+	for month := first; !month.After(last); month = month.AddDate(0, 1, 0) {
+		months = append(months, month)
 	}
+
+	return months, nil
 }
 
 func main() {
+	var options Options
+	var show string
+	var notifiers string
+	var checkFolders bool
+	var watch time.Duration
+	var logLevel string
+	var logJSON bool
+	var timezone string
+	var proxy string
+	var noCache bool
+	var dumpText bool
+	var only string
+	var skip string
+	var from string
+	var to string
+	flag.StringVar(&from, "from", "", "First month (YYYY-MM or YYYY-MM-DD) of a range to scrape instead of a single month")
+	flag.StringVar(&to, "to", "", "Last month (YYYY-MM or YYYY-MM-DD) of the range, defaults to the current month")
+	flag.StringVar(&options.ConfigPath, "config", "configuration.json", "Path to the configuration file")
+	flag.StringVar(&options.CredentialsPath, "credentials", "credentials.json", "Path to the google OAuth client secret file")
+	flag.StringVar(&options.TokenPath, "token", "token.json", "Path to the file caching the google OAuth token")
+	flag.DurationVar(&watch, "watch", 0, "Re-check the current month at this interval and alert about missing required invoices")
+	flag.BoolVar(&checkFolders, "check-folders", false, "Check that every DriveDestination is a folder you can write to and exit")
+	flag.StringVar(&show, "show", "", "List the invoices archived in Drive for a month (YYYY-MM or 'now') and exit")
+	flag.StringVar(&options.HistoryPath, "history", "history.json", "Path to the local history of extracted values")
+	flag.StringVar(&options.IndexPath, "index", "", "Record every uploaded invoice file, with its id, value and upload time, in this JSON file")
+	flag.BoolVar(&options.WarnUnchanged, "warn-unchanged", false, "Warn when an invoice value equals the previous month's value")
+	flag.StringVar(&options.NotifyFile, "notify-file", "", "Also write the notification message to this file")
+	flag.StringVar(&options.NotifyStatePath, "notify-state", "", "Keep the invoices of the run's notifications in this file, for the notify command to send them again")
+	flag.StringVar(&options.NotifyTemplate, "notify-template", "", "Render the notification message with this Go text/template file instead of the built-in format")
+	flag.StringVar(&options.Storage, "storage", "drive", "Where to archive invoices: drive or s3")
+	flag.BoolVar(&options.AttachmentInfo, "attachment-info", false, "Include attachment names and sizes in the notification")
+	flag.BoolVar(&options.MessageLinks, "message-links", false, "Include a link to each invoice's Gmail message in the notification")
+	flag.StringVar(&notifiers, "notifiers", "signal", "Comma-separated notifiers to try in order: signal, smtp, telegram, email")
+	flag.BoolVar(&options.StreamToDisk, "stream-to-disk", false, "Keep attachments in temporary files instead of memory")
+	flag.BoolVar(&dumpText, "dump-text", false, "Print the text extracted from every matching message of the month, to tune the price delimiters, without extracting prices or saving anything")
+	flag.BoolVar(&options.DryRun, "dry-run", false, "Scrape and print the summary without uploading or sending the notification")
+	flag.StringVar(&options.BeancountOut, "beancount-out", "", "Append the invoices as Beancount transactions to this file")
+	flag.StringVar(&options.OutputPath, "output", "", "Write a summary of the extracted invoices to this file, as JSON if it ends in .json or CSV otherwise")
+	flag.StringVar(&pdftotextPath, "pdftotext-path", "pdftotext", "pdftotext binary to extract pdf text with, looked up in PATH by default")
+	flag.StringVar(&pdfBackend, "pdf-backend", "pdftotext", "PDF text extraction backend: pdftotext, or go to use a pure Go library and fall back to pdftotext")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+	flag.BoolVar(&logJSON, "log-json", false, "Log messages as JSON lines")
+	flag.StringVar(&options.MetricsPath, "metrics-file", "", "Write node_exporter textfile metrics of the run to this file")
+	flag.StringVar(&options.Label, "label", "", "Apply this Gmail label, created if needed, to the messages invoices were scraped from")
+	flag.BoolVar(&options.Incremental, "incremental", false, "Scrape only messages received since the last successful run, instead of a given month")
+	flag.StringVar(&options.ProgressPath, "progress", ".backfill_progress.json", "Path of the file recording the months of a -from/-to range already completed, so running it again resumes")
+	flag.BoolVar(&options.Force, "force", false, "Process every month of a -from/-to range, even those already completed")
+	flag.StringVar(&options.LastRunPath, "last-run", ".last_run", "Path of the file recording when the last successful -incremental run started")
+	flag.BoolVar(&options.Overwrite, "overwrite", false, "Replace invoice files that already exist instead of skipping them")
+	flag.DurationVar(&options.Timeout, "timeout", 5*time.Minute, "Fail a month if processing it takes longer than this, 0 to never time out")
+	flag.IntVar(&options.Concurrency, "concurrency", 4, "Number of sources scraped at the same time")
+	flag.StringVar(&proxy, "proxy", "", "Proxy url Google and notifier API requests go through, e.g. http://proxy.example:3128, defaults to HTTPS_PROXY")
+	flag.StringVar(&timezone, "timezone", "", "IANA timezone months start and end in when searching emails, e.g. Europe/Lisbon, defaults to the local one")
+	flag.StringVar(&options.CacheDir, "cache-dir", defaultCacheDir(), "Directory fetched attachments are cached in, so re-runs don't download them again")
+	flag.BoolVar(&options.Quiet, "quiet", false, "Don't print the table of invoices of each month")
+	flag.StringVar(&only, "only", "", "Comma-separated source BillNames or group Names to scrape, leaving the others out")
+	flag.StringVar(&skip, "skip", "", "Comma-separated source BillNames or group Names not to scrape")
+	flag.BoolVar(&noCache, "no-cache", false, "Always fetch attachments from Gmail, without reading or writing the cache")
 	flag.Parse()
 
-	month := flag.Arg(0)
+	err := setupLogging(logLevel, logJSON)
+	if err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	}
+
+	err = setupProxy(proxy)
+	if err != nil {
+		log.Fatalf("Invalid -proxy: %v", err)
+	}
+
+	options.Timezone = time.Local
+	if timezone != "" {
+		options.Timezone, err = time.LoadLocation(timezone)
+		if err != nil {
+			log.Fatalf("Invalid -timezone: %v", err)
+		}
+	}
+
+	options.Notifiers = strings.Split(notifiers, ",")
+	if only != "" {
+		options.Only = strings.Split(only, ",")
+	}
+	if skip != "" {
+		options.Skip = strings.Split(skip, ",")
+	}
 
-	if month == "" {
-		log.Fatalf("Please provide a month in YYYY-MM format or 'now' for current month")
+	if flag.Arg(0) == "auth" {
+		authenticateGoogle(options.CredentialsPath, accountTokenPath(options.TokenPath, flag.Arg(1)))
 		return
 	}
 
-	var monthTime time.Time
-	var err error
-	if month == "now" {
-		now := time.Now()
-		monthTime = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if noCache {
+		options.CacheDir = ""
+	}
+
+	if flag.Arg(0) == "clear-cache" {
+		err := clearAttachmentCache(options.CacheDir)
+		if err != nil {
+			log.Fatalf("Unable to clear the attachment cache: %v", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "notify" {
+		err := resendNotifications(options)
+		if err != nil {
+			log.Fatalf("Unable to send notification again: %v", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "check" {
+		checkConfiguration(options)
+		return
+	}
+
+	if flag.Arg(0) == "selftest" {
+		manifestPath := flag.Arg(1)
+		if manifestPath == "" {
+			manifestPath = "fixtures.json"
+		}
+		err := runSelftest(options, manifestPath)
+		if err != nil {
+			log.Fatalf("Self-test failed: %v", err)
+		}
+		return
+	}
+
+	if show != "" {
+		showMonth, err := parseMonth(show)
+		if err != nil {
+			log.Fatalf("Error parsing month: %v", err)
+		}
+		showArchivedInvoices(showMonth, options)
+		return
+	}
+
+	if checkFolders {
+		checkDriveFolders(options)
+		return
+	}
+
+	if watch > 0 {
+		err := watchRequiredInvoices(watch, options)
+		if err != nil {
+			log.Fatalf("Watch failed: %v", err)
+		}
+		return
+	}
+
+	var months []time.Time
+	if options.Incremental {
+		lastRun, err := loadLastRun(options.LastRunPath)
+		if err != nil {
+			log.Fatalf("Unable to read last run file: %v", err)
+		}
+		months, err = incrementalMonths(lastRun)
+		if err != nil {
+			log.Fatalf("Error computing months since last run: %v", err)
+		}
+	} else if from != "" || to != "" {
+		months, err = monthRange(from, to)
+		if err != nil {
+			log.Fatalf("Error parsing date range: %v", err)
+		}
+		options.Backfill = true
 	} else {
-		monthTime, err = time.Parse("2006-01", month)
+		month := flag.Arg(0)
+
+		if month == "" {
+			log.Fatalf("Please provide a month in YYYY-MM format or 'now' for current month")
+			return
+		}
+
+		monthTime, err := parseMonth(month)
 		if err != nil {
 			log.Fatalf("Error parsing month: %v", err)
 		}
+		months = []time.Time{monthTime}
+	}
+
+	if dumpText {
+		err = dumpInvoiceText(months, options)
+		if err != nil {
+			log.Fatalf("Unable to dump invoice text: %v", err)
+		}
+		return
+	}
+
+	err = invoiceManager(months, options)
+	if errors.Is(err, errPartialFailure) {
+		slog.Error("Invoice manager finished with failures", "error", err)
+		os.Exit(partialFailureExitCode)
+	}
+	if err != nil {
+		log.Fatalf("Invoice manager failed: %v", err)
 	}
-	invoiceManager(monthTime)
 }
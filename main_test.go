@@ -0,0 +1,1144 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/gmail/v1"
+)
+
+// In-memory inbox, all messages match any query. Messages are listed in id
+// order, pageSize at a time when set.
+type fakeMessages struct {
+	messages    map[string]*gmail.Message
+	attachments map[string]string
+	pageSize    int
+}
+
+func (f *fakeMessages) ListMessages(ctx context.Context, query string, pageToken string) (*gmail.ListMessagesResponse, error) {
+	var ids []string
+	for id := range f.messages {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	start := 0
+	if pageToken != "" {
+		var err error
+		start, err = strconv.Atoi(pageToken)
+		if err != nil {
+			return nil, fmt.Errorf("invalid page token %q", pageToken)
+		}
+	}
+	end := len(ids)
+	if f.pageSize > 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+	}
+
+	resp := &gmail.ListMessagesResponse{}
+	for _, id := range ids[start:end] {
+		resp.Messages = append(resp.Messages, &gmail.Message{Id: id})
+	}
+	if end < len(ids) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+func (f *fakeMessages) GetMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	msg, ok := f.messages[id]
+	if !ok {
+		return nil, fmt.Errorf("no message %s", id)
+	}
+	return msg, nil
+}
+
+func (f *fakeMessages) GetAttachment(ctx context.Context, messageId string, attachmentId string) (*gmail.MessagePartBody, error) {
+	data, ok := f.attachments[attachmentId]
+	if !ok {
+		return nil, fmt.Errorf("no attachment %s", attachmentId)
+	}
+	return &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(data))}, nil
+}
+
+// In-memory Drive, understanding only the name and parents query clauses
+type fakeFiles struct {
+	files   []*drive.File
+	created []string
+	updated []string
+}
+
+var (
+	fakeNameClause   = regexp.MustCompile(`name = '([^']*)'`)
+	fakeParentClause = regexp.MustCompile(`'([^']*)' in parents`)
+)
+
+func (f *fakeFiles) ListFiles(ctx context.Context, query string, fields string) ([]*drive.File, error) {
+	var found []*drive.File
+	for _, file := range f.files {
+		if m := fakeNameClause.FindStringSubmatch(query); m != nil && m[1] != file.Name {
+			continue
+		}
+		if m := fakeParentClause.FindStringSubmatch(query); m != nil && (len(file.Parents) == 0 || m[1] != file.Parents[0]) {
+			continue
+		}
+		found = append(found, file)
+	}
+	return found, nil
+}
+
+func (f *fakeFiles) CreateFile(ctx context.Context, file *drive.File, media io.Reader) (*drive.File, error) {
+	created := *file
+	created.Id = fmt.Sprintf("id-%d", len(f.files))
+	f.files = append(f.files, &created)
+	if media != nil {
+		f.created = append(f.created, file.Name)
+	}
+	return &created, nil
+}
+
+func (f *fakeFiles) UpdateFile(ctx context.Context, id string, file *drive.File, media io.Reader) (*drive.File, error) {
+	if media != nil {
+		f.updated = append(f.updated, id)
+	}
+	return file, nil
+}
+
+var testMonth = time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+func testSource() Source {
+	return Source{
+		BillName:               "Water",
+		From:                   Senders{"billing@water.example"},
+		SubjectContains:        "Invoice",
+		AttachmentNameContains: "invoice",
+		Location:               Locations{"body"},
+		StringBeforePrice:      "Total:",
+		StringAfterPrice:       "€",
+	}
+}
+
+// Message with an html body holding the price and, unless attachmentId is
+// empty, a pdf attachment
+func testMessage(id string, attachmentId string) *gmail.Message {
+	body := base64.URLEncoding.EncodeToString([]byte("<p>Total: 12,34 €</p>"))
+
+	parts := []*gmail.MessagePart{
+		{MimeType: "text/html", Body: &gmail.MessagePartBody{Data: body}},
+	}
+	if attachmentId != "" {
+		parts = append(parts, &gmail.MessagePart{
+			MimeType: "application/pdf",
+			Filename: "invoice-03.pdf",
+			Body:     &gmail.MessagePartBody{AttachmentId: attachmentId, Size: 7},
+		})
+	}
+
+	return &gmail.Message{
+		Id:           id,
+		InternalDate: time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC).UnixMilli(),
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Headers:  []*gmail.MessagePartHeader{{Name: "Subject", Value: "Your Invoice"}},
+			Parts:    parts,
+		},
+	}
+}
+
+// The Home group with the given sources, or testSource without any
+func testConfigs(sources ...Source) []SourceConfig {
+	if len(sources) == 0 {
+		sources = []Source{testSource()}
+	}
+	return []SourceConfig{{Name: "Home", Sources: sources}}
+}
+
+// Scrapes the test month's invoices of configs from messages, which stand
+// for the inbox of every account, one source at a time
+func scrapeTestGroups(messages *fakeMessages, configs []SourceConfig, scrape scrapeOptions) []InvoiceGroup {
+	accountMessages := map[string]messageLister{"": messages}
+	for _, config := range configs {
+		accountMessages[config.Account] = messages
+	}
+
+	scrape.Concurrency = 1
+	return scrapeInvoiceGroups(context.Background(), accountMessages, testMonth, configs, scrape)
+}
+
+// Scrapes the invoice of testSource in the Home group, failing the test
+// unless there's exactly one
+func scrapeTestGroup(t *testing.T, messages *fakeMessages) InvoiceGroup {
+	t.Helper()
+
+	invoiceGroups := scrapeTestGroups(messages, testConfigs(), scrapeOptions{})
+
+	if len(invoiceGroups) != 1 || len(invoiceGroups[0].Invoices) != 1 {
+		t.Fatalf("expected one group with one invoice, got %+v", invoiceGroups)
+	}
+
+	return invoiceGroups[0]
+}
+
+func TestScrapeInvoiceGroups(t *testing.T) {
+	messages := &fakeMessages{
+		messages:    map[string]*gmail.Message{"m1": testMessage("m1", "a1")},
+		attachments: map[string]string{"a1": "%PDF-1.4"},
+	}
+
+	invoiceGroup := scrapeTestGroup(t, messages)
+	invoice := invoiceGroup.Invoices[0]
+
+	if invoice.ProcessingError != "" {
+		t.Fatalf("unexpected error: %s", invoice.ProcessingError)
+	}
+	if invoice.Value != 1234 {
+		t.Errorf("expected value 1234, got %d", invoice.Value)
+	}
+	if invoice.FileName != "Water.pdf" {
+		t.Errorf("expected file Water.pdf, got %q", invoice.FileName)
+	}
+	if string(invoice.FileContents) != "%PDF-1.4" {
+		t.Errorf("expected the attachment contents, got %q", invoice.FileContents)
+	}
+	if invoice.MessageId != "m1" {
+		t.Errorf("expected message m1, got %q", invoice.MessageId)
+	}
+}
+
+func TestScrapeInvoiceGroupsPlainTextBody(t *testing.T) {
+	message := testMessage("m1", "a1")
+	message.Payload.Parts[0] = &gmail.MessagePart{
+		MimeType: "text/plain",
+		Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte("Total: 56,78 €\n"))},
+	}
+	messages := &fakeMessages{
+		messages:    map[string]*gmail.Message{"m1": message},
+		attachments: map[string]string{"a1": "%PDF-1.4"},
+	}
+
+	invoice := scrapeTestGroup(t, messages).Invoices[0]
+
+	if invoice.ProcessingError != "" {
+		t.Fatalf("unexpected error: %s", invoice.ProcessingError)
+	}
+	if invoice.Value != 5678 {
+		t.Errorf("expected the value of the text/plain body, got %d", invoice.Value)
+	}
+}
+
+func TestScrapeInvoiceGroupsSecondPage(t *testing.T) {
+	messages := &fakeMessages{
+		messages: map[string]*gmail.Message{
+			// Without an attachment, so the source goes on to page 2
+			"m1": testMessage("m1", ""),
+			"m2": testMessage("m2", "a2"),
+		},
+		attachments: map[string]string{"a2": "%PDF-1.4"},
+		pageSize:    1,
+	}
+
+	invoice := scrapeTestGroup(t, messages).Invoices[0]
+
+	if invoice.MessageId != "m2" || invoice.Value != 1234 {
+		t.Errorf("expected the invoice of message m2 on page 2, got %+v", invoice)
+	}
+}
+
+func TestScrapeInvoiceGroupsMissingAttachment(t *testing.T) {
+	messages := &fakeMessages{
+		messages: map[string]*gmail.Message{"m1": testMessage("m1", "")},
+	}
+
+	invoiceGroups := scrapeTestGroups(messages, testConfigs(), scrapeOptions{})
+
+	if len(invoiceGroups) != 1 || len(invoiceGroups[0].Invoices) != 0 {
+		t.Errorf("expected the group without invoices, got %+v", invoiceGroups)
+	}
+}
+
+func TestScrapeInvoiceGroupsAnchorUnreadableLocation(t *testing.T) {
+	t.Setenv("EIM_TEST_PDF_PASSWORD", "")
+	messages := &fakeMessages{
+		messages:    map[string]*gmail.Message{"m1": testMessage("m1", "a1")},
+		attachments: map[string]string{"a1": "%PDF-1.4"},
+	}
+
+	// The attachment can't be read without its password, the body is read
+	// but lacks the anchor
+	source := testSource()
+	source.Location = Locations{"attachment", "body"}
+	source.PDFPasswordEnv = "EIM_TEST_PDF_PASSWORD"
+	source.RequireAnchor = "Invoice number"
+
+	configs := testConfigs(source)
+	invoiceGroups := scrapeTestGroups(messages, configs, scrapeOptions{})
+
+	if len(invoiceGroups) != 1 || len(invoiceGroups[0].Invoices) != 0 {
+		t.Errorf("expected the message to be skipped, got %+v", invoiceGroups)
+	}
+
+	// Without any readable location the anchor can't be decided
+	configs[0].Sources[0].Location = Locations{"attachment"}
+	invoiceGroups = scrapeTestGroups(messages, configs, scrapeOptions{})
+
+	if len(invoiceGroups[0].Invoices) != 1 || !strings.Contains(invoiceGroups[0].Invoices[0].ProcessingError, "EIM_TEST_PDF_PASSWORD is not set") {
+		t.Errorf("expected the extraction error, got %+v", invoiceGroups[0].Invoices)
+	}
+}
+
+func TestScrapeInvoiceGroupsDumpText(t *testing.T) {
+	messages := &fakeMessages{
+		messages:    map[string]*gmail.Message{"m1": testMessage("m1", "a1")},
+		attachments: map[string]string{"a1": "%PDF-1.4"},
+	}
+
+	dump := strings.Builder{}
+	invoiceGroups := scrapeTestGroups(messages, testConfigs(), scrapeOptions{DumpText: &dump})
+
+	if len(invoiceGroups[0].Invoices) != 0 {
+		t.Errorf("expected no invoices, got %+v", invoiceGroups[0].Invoices)
+	}
+	if !strings.Contains(dump.String(), "===== Water, body of") || !strings.Contains(dump.String(), "Total: 12,34 €\n") {
+		t.Errorf("expected the body text, got:\n%s", dump.String())
+	}
+}
+
+func TestScrapeInvoiceGroupsSkipsMessagesOutsideTimezoneMonth(t *testing.T) {
+	// Still March in UTC, but already April two hours ahead
+	message := testMessage("m1", "a1")
+	message.InternalDate = time.Date(2024, time.March, 31, 23, 0, 0, 0, time.UTC).UnixMilli()
+
+	messages := &fakeMessages{
+		messages:    map[string]*gmail.Message{"m1": message},
+		attachments: map[string]string{"a1": "%PDF-1.4"},
+	}
+
+	invoiceGroups := scrapeTestGroups(messages, testConfigs(), scrapeOptions{Location: time.FixedZone("UTC+2", 2*60*60)})
+
+	if len(invoiceGroups[0].Invoices) != 0 {
+		t.Errorf("expected the message to be skipped, got %+v", invoiceGroups[0].Invoices)
+	}
+}
+
+func TestScrapeWindow(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+
+	start, end := testSource().scrapeWindow(testMonth, loc)
+
+	if !start.Equal(time.Date(2024, time.March, 1, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the window to start at midnight on March 1st in loc, got %v", start)
+	}
+	if !end.Equal(time.Date(2024, time.April, 1, 5, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the window to end at midnight on April 1st in loc, got %v", end)
+	}
+}
+
+func TestScrapeInvoiceGroupsLargestAttachment(t *testing.T) {
+	small := testMessage("m1", "a1")
+	large := testMessage("m2", "a2")
+	large.Payload.Parts[1].Body.Size = 70
+
+	messages := &fakeMessages{
+		messages:    map[string]*gmail.Message{"m1": small, "m2": large},
+		attachments: map[string]string{"a1": "small", "a2": "large"},
+	}
+
+	source := testSource()
+	source.SelectStrategy = selectLargestAttachment
+	configs := testConfigs(source)
+
+	invoiceGroups := scrapeTestGroups(messages, configs, scrapeOptions{})
+
+	invoice := invoiceGroups[0].Invoices[0]
+	if invoice.MessageId != "m2" || string(invoice.FileContents) != "large" {
+		t.Errorf("expected the invoice of the largest attachment, got %+v", invoice)
+	}
+}
+
+func TestScrapeInvoiceGroupsAlreadySaved(t *testing.T) {
+	// Any Gmail call fails
+	messages := &fakeMessages{}
+
+	invoiceGroups := scrapeTestGroups(messages, testConfigs(), scrapeOptions{
+		Saved: func(invoiceGroup InvoiceGroup, fileName string, billName string) (int64, bool) {
+			return 999, fileName == "Water.pdf"
+		},
+	})
+
+	invoice := invoiceGroups[0].Invoices[0]
+	if !invoice.AlreadySaved || invoice.Value != 999 {
+		t.Errorf("expected the saved invoice, got %+v", invoice)
+	}
+}
+
+func TestFetchAttachmentCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	attachmentPart := testMessage("m1", "a1").Payload.Parts[1]
+
+	messages := &fakeMessages{attachments: map[string]string{"a1": "%PDF-1.4"}}
+	_, _, _, err := fetchAttachment(context.Background(), messages, "m1", attachmentPart, "", cacheDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Any Gmail call fails, so the attachment must come from the cache
+	contents, _, size, err := fetchAttachment(context.Background(), &fakeMessages{}, "m1", attachmentPart, "", cacheDir)
+	if err != nil {
+		t.Fatalf("expected the cached attachment, got %v", err)
+	}
+	if string(contents) != "%PDF-1.4" || size != 8 {
+		t.Errorf("expected the attachment contents, got %q (%d bytes)", contents, size)
+	}
+}
+
+func testInvoiceGroups() []InvoiceGroup {
+	return []InvoiceGroup{{
+		Name:             "Home",
+		DriveDestination: "root",
+		Invoices: []Invoice{
+			{BillName: "Water", FileName: "Water.pdf", Value: 1234, FileContents: []byte("water")},
+			{BillName: "Power", FileName: "Power.pdf", Value: 5678, FileContents: []byte("power")},
+		},
+	}}
+}
+
+func TestUploadInvoices(t *testing.T) {
+	files := &fakeFiles{}
+	invoiceGroups := testInvoiceGroups()
+
+	uploadInvoices(context.Background(), files, testMonth, invoiceGroups, false, false)
+
+	for _, invoice := range invoiceGroups[0].Invoices {
+		if invoice.ProcessingError != "" {
+			t.Errorf("unexpected error on %s: %s", invoice.BillName, invoice.ProcessingError)
+		}
+		if invoice.StorageId == "" {
+			t.Errorf("expected the file id of %s", invoice.BillName)
+		}
+	}
+
+	if len(files.files) != 3 || files.files[0].Name != "2024_3" {
+		t.Fatalf("expected the month folder and two files, got %+v", files.files)
+	}
+	for _, file := range files.files[1:] {
+		if file.Parents[0] != files.files[0].Id {
+			t.Errorf("expected %s in the month folder, got parents %v", file.Name, file.Parents)
+		}
+	}
+}
+
+func TestUploadInvoicesAfterFailedInvoice(t *testing.T) {
+	files := &fakeFiles{}
+	invoiceGroups := testInvoiceGroups()
+	invoiceGroups[0].Invoices[0] = Invoice{BillName: "Water", ProcessingError: "unable to extract price"}
+
+	uploadInvoices(context.Background(), files, testMonth, invoiceGroups, false, false)
+
+	if len(files.files) != 2 || files.files[0].Name != "2024_3" {
+		t.Fatalf("expected the month folder and one file, got %+v", files.files)
+	}
+	if len(files.created) != 1 || files.created[0] != "Power.pdf" {
+		t.Errorf("expected Power.pdf to be uploaded, got %v", files.created)
+	}
+
+	// Running again reuses the folder
+	uploadInvoices(context.Background(), files, testMonth, testInvoiceGroups(), false, false)
+
+	folders := 0
+	for _, file := range files.files {
+		if file.Name == "2024_3" {
+			folders++
+		}
+	}
+	if folders != 1 {
+		t.Errorf("expected a single month folder, got %d", folders)
+	}
+}
+
+func TestUploadInvoicesSkipsExistingFiles(t *testing.T) {
+	files := &fakeFiles{files: []*drive.File{
+		{Id: "folder", Name: "2024_3", Parents: []string{"root"}},
+		{Id: "water", Name: "Water.pdf", Parents: []string{"folder"}},
+	}}
+
+	uploadInvoices(context.Background(), files, testMonth, testInvoiceGroups(), false, false)
+
+	if len(files.created) != 1 || files.created[0] != "Power.pdf" {
+		t.Errorf("expected only Power.pdf to be uploaded, got %v", files.created)
+	}
+	if len(files.updated) != 0 {
+		t.Errorf("expected no file to be replaced, got %v", files.updated)
+	}
+}
+
+func TestUploadInvoicesOverwrite(t *testing.T) {
+	files := &fakeFiles{files: []*drive.File{
+		{Id: "folder", Name: "2024_3", Parents: []string{"root"}},
+		{Id: "water", Name: "Water.pdf", Parents: []string{"folder"}},
+	}}
+
+	uploadInvoices(context.Background(), files, testMonth, testInvoiceGroups(), false, true)
+
+	if len(files.updated) != 1 || files.updated[0] != "water" {
+		t.Errorf("expected Water.pdf to be replaced, got %v", files.updated)
+	}
+	if len(files.created) != 1 || files.created[0] != "Power.pdf" {
+		t.Errorf("expected only Power.pdf to be uploaded, got %v", files.created)
+	}
+}
+
+func TestGmailQuery(t *testing.T) {
+	source := testSource()
+	source.SubjectContains = `Your "monthly" invoice`
+	source.Label = "bills/water"
+
+	query := gmailQuery(source, "2024/3/1", "2024/4/1")
+
+	expected := `after:2024/3/1 before:2024/4/1 from:billing@water.example has:attachment subject:"Your monthly invoice" label:"bills/water"`
+	if query != expected {
+		t.Errorf("expected query %q, got %q", expected, query)
+	}
+
+	source.QueryOverride = "from:(a@water.example OR b@water.example) -subject:reminder"
+	query = gmailQuery(source, "2024/3/1", "2024/4/1")
+
+	expected = "after:2024/3/1 before:2024/4/1 from:(a@water.example OR b@water.example) -subject:reminder"
+	if query != expected {
+		t.Errorf("expected query %q, got %q", expected, query)
+	}
+}
+
+func TestSendersQuery(t *testing.T) {
+	var source Source
+	err := json.Unmarshal([]byte(`{"From": "billing@acme.example"}`), &source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query := source.From.query(); query != "from:billing@acme.example" {
+		t.Errorf("expected a single from term, got %q", query)
+	}
+
+	err = json.Unmarshal([]byte(`{"From": ["noreply@billing.acme.example", "acme.example"]}`), &source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query := source.From.query(); query != "from:(noreply@billing.acme.example OR acme.example)" {
+		t.Errorf("expected the senders joined with OR, got %q", query)
+	}
+}
+
+func TestRenderFileName(t *testing.T) {
+	date := time.Date(2024, time.March, 10, 15, 0, 0, 0, time.UTC)
+
+	for template, expected := range map[string]string{
+		"":                          "Water.pdf",
+		"{bill}-{year}-{month}.pdf": "Water-2024-03.pdf",
+		"{date} {bill}.pdf":         "2024-03-10 Water.pdf",
+		"{bill}-{attachment}":       "Water-Factura 03.XML",
+		"{bill}{ext}":               "Water.xml",
+	} {
+		fileName := renderFileName(template, "Water", testMonth, date, "Factura 03.XML")
+		if fileName != expected {
+			t.Errorf("template %q: expected %q, got %q", template, expected, fileName)
+		}
+	}
+}
+
+func TestExtractPriceCollapseWhitespace(t *testing.T) {
+	source := testSource()
+	source.StringBeforePrice = "Total due €"
+	source.StringAfterPrice = "\n"
+	source.CollapseWhitespace = true
+
+	text := source.normalizeText("Invoice\n\nTotal   due\n€12,34\nThank you")
+
+	value, err := extractPrice(text, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 1234 {
+		t.Errorf("expected value 1234, got %d", value)
+	}
+}
+
+func TestExtractPriceBetweenTwoStrings(t *testing.T) {
+	format := testSource().numberFormat()
+
+	for _, test := range []struct {
+		haystack string
+		expected int64
+	}{
+		{"Total: 12,34 €\n", 1234},
+		{"Total: 1.234,56 €\n", 123456},
+		{"Total: 12.345,00 €\n", 1234500},
+	} {
+		value, err := extractPriceBetweenTwoStrings(test.haystack, "Total:", "€", 0, format)
+		if err != nil {
+			t.Errorf("%q: %v", test.haystack, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.haystack, test.expected, value)
+		}
+	}
+}
+
+func TestExtractPriceBetweenTwoStringsOccurrence(t *testing.T) {
+	haystack := "Subtotal: 10,00 €\nTaxes: 2,30 €\nSubtotal: 5,00 €\nTotal: 17,30 €\n"
+	format := testSource().numberFormat()
+
+	for _, test := range []struct {
+		occurrence int
+		expected   int64
+	}{
+		{0, 1000},
+		{1, 1000},
+		{2, 230},
+		{4, 1730},
+		{-1, 1730},
+	} {
+		value, err := extractPriceBetweenTwoStrings(haystack, ": ", " €", test.occurrence, format)
+		if err != nil {
+			t.Errorf("occurrence %d: %v", test.occurrence, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("occurrence %d: expected %d, got %d", test.occurrence, test.expected, value)
+		}
+	}
+
+	_, err := extractPriceBetweenTwoStrings(haystack, ": ", " €", 5, format)
+	if err == nil {
+		t.Error("expected an error for a missing occurrence")
+	}
+}
+
+func TestUploadInvoicesBillingPeriod(t *testing.T) {
+	files := &fakeFiles{}
+	invoiceGroups := testInvoiceGroups()
+	invoiceGroups[0].Invoices[0].BillingPeriod = time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)
+
+	uploadInvoices(context.Background(), files, testMonth, invoiceGroups, false, false)
+
+	folders := map[string]string{}
+	for _, file := range files.files {
+		if file.Parents[0] == "root" {
+			folders[file.Id] = file.Name
+		}
+	}
+	for _, file := range files.files {
+		expected := map[string]string{"Water.pdf": "2024_2", "Power.pdf": "2024_3"}[file.Name]
+		if expected != "" && folders[file.Parents[0]] != expected {
+			t.Errorf("expected %s in folder %s, got %s", file.Name, expected, folders[file.Parents[0]])
+		}
+	}
+	if len(folders) != 2 {
+		t.Errorf("expected two month folders, got %v", folders)
+	}
+}
+
+func TestExtractPricesExtractions(t *testing.T) {
+	source := testSource()
+	source.Extractions = []Extraction{
+		{Name: "Energy", StringBeforePrice: "Energy:", StringAfterPrice: "€"},
+		{Name: "Standing charge", StringBeforePrice: "Standing charge:", StringAfterPrice: "€"},
+	}
+
+	prices, err := extractPrices("Energy: 30,00 € Standing charge: 15,50 € Total: 45,50 €", source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(prices) != 2 || prices[0] != 3000 || prices[1] != 1550 {
+		t.Errorf("expected [3000 1550], got %v", prices)
+	}
+
+	if !isSourceBill("Water (Standing charge)", source) {
+		t.Errorf("expected the extraction bill to belong to the source")
+	}
+}
+
+func TestBillingPeriod(t *testing.T) {
+	source := testSource()
+	source.BillingPeriodRegex = `Period: (?P<month>\d{2})/(?P<year>\d{2,4})`
+
+	period := source.billingPeriod("Invoice\nPeriod: 02/24\nTotal: 12,34 €")
+	if !period.Equal(time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected February 2024, got %v", period)
+	}
+
+	if period := source.billingPeriod("Total: 12,34 €"); !period.IsZero() {
+		t.Errorf("expected no period without a match, got %v", period)
+	}
+}
+
+func TestDecodeBase64(t *testing.T) {
+	for _, data := range []string{"b2s_-_8=", "b2s_-_8", "b2s/+/8=", "b2s/+/8"} {
+		decoded, err := decodeBase64(data)
+		if err != nil {
+			t.Errorf("unable to decode %q: %v", data, err)
+			continue
+		}
+		if string(decoded) != "ok?\xfb\xff" {
+			t.Errorf("expected %q to decode to %q, got %q", data, "ok?\xfb\xff", decoded)
+		}
+	}
+}
+
+func TestExtractTextFromHtmlTableRows(t *testing.T) {
+	body := `<p>Your invoice</p><table>
+		<tr><th>Item</th><th>Amount</th></tr>
+		<tr><td><b>Total</b> due</td><td>€12,34</td></tr>
+	</table>`
+
+	text := extractTextFromHtml(body, " | ")
+
+	expected := "Your invoice\nItem | Amount\nTotal due | €12,34\n"
+	if text != expected {
+		t.Errorf("expected %q, got %q", expected, text)
+	}
+
+	if text := extractTextFromHtml(body, ""); !strings.Contains(text, "Total\ndue\n€12,34\n") {
+		t.Errorf("expected one line per text without a separator, got %q", text)
+	}
+}
+
+func TestSetupProxyRejectsUrlsWithoutScheme(t *testing.T) {
+	err := setupProxy("proxy.example:3128")
+	if err == nil {
+		t.Errorf("expected an error for a proxy without scheme")
+	}
+	if baseTransport != http.DefaultTransport {
+		t.Errorf("expected the default transport to be kept")
+	}
+}
+
+func TestReadFileOrEnvPrefersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	t.Setenv(tokenEnv, `{"access_token":"from-env"}`)
+
+	tok, err := tokenFromFile(path, tokenEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "from-env" {
+		t.Errorf("expected the token from the environment, got %q", tok.AccessToken)
+	}
+
+	err = os.WriteFile(path, []byte(`{"access_token":"from-file"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err = tokenFromFile(path, tokenEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "from-file" {
+		t.Errorf("expected the token from the file, got %q", tok.AccessToken)
+	}
+}
+
+func TestAccountTokenEnv(t *testing.T) {
+	if env := accountTokenEnv(""); env != "EIM_TOKEN" {
+		t.Errorf("expected EIM_TOKEN, got %s", env)
+	}
+	if env := accountTokenEnv("work-mail"); env != "EIM_TOKEN_WORK_MAIL" {
+		t.Errorf("expected EIM_TOKEN_WORK_MAIL, got %s", env)
+	}
+}
+
+func TestStripCurrency(t *testing.T) {
+	for _, amount := range []string{"€12,34", "12,34 €", "EUR12,34"} {
+		if stripped := stripCurrency(amount); stripped != "12,34" {
+			t.Errorf("%q: expected 12,34, got %q", amount, stripped)
+		}
+
+		value, err := parseCents(amount, testSource().numberFormat())
+		if err != nil || value != 1234 {
+			t.Errorf("%q: expected 1234, got %d (%v)", amount, value, err)
+		}
+	}
+}
+
+func TestParseCents(t *testing.T) {
+	european := numberFormat{DecimalSeparator: ",", ThousandsSeparator: ".", Decimals: 2}
+	us := numberFormat{DecimalSeparator: ".", ThousandsSeparator: ",", Decimals: 2}
+
+	for _, test := range []struct {
+		amount   string
+		format   numberFormat
+		expected int64
+	}{
+		{"1.234,56", european, 123456},
+		{"1,234.56", us, 123456},
+		{"99,9", european, 9990},
+		{"0,05", european, 5},
+	} {
+		value, err := parseCents(test.amount, test.format)
+		if err != nil {
+			t.Errorf("%q: %v", test.amount, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.amount, test.expected, value)
+		}
+	}
+
+	if _, err := parseCents("12,345", european); err == nil {
+		t.Error("expected an error for three decimal digits")
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	for _, test := range []struct {
+		amount   string
+		expected int64
+	}{
+		{"1.234,56", 123456},
+		{"1,234.56", 123456},
+		{"1234.5", 123450},
+		{"12,34", 1234},
+		{"1 234,56", 123456},
+		{"1 234,56", 123456},
+		{"1.234.567", 123456700},
+		{"1,234", 123400},
+		{"1234", 123400},
+		{"€ 12.30", 1230},
+	} {
+		value, err := parseAmount(test.amount, 2)
+		if err != nil {
+			t.Errorf("%q: %v", test.amount, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.amount, test.expected, value)
+		}
+	}
+
+	for _, amount := range []string{"", "12,3456", "1.234,567", "12-34"} {
+		if _, err := parseAmount(amount, 2); err == nil {
+			t.Errorf("%q: expected an error", amount)
+		}
+	}
+}
+
+func TestFilterSources(t *testing.T) {
+	power := testSource()
+	power.BillName = "Power"
+	configs := []SourceConfig{
+		{Name: "Home", Sources: []Source{testSource(), power}},
+		{Name: "Office", Sources: []Source{{BillName: "Internet"}}},
+	}
+
+	filtered, err := filterSources(configs, []string{"Water", "Office"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 2 || len(filtered[0].Sources) != 1 || filtered[0].Sources[0].BillName != "Water" || filtered[1].Name != "Office" {
+		t.Errorf("expected Water and the Office group, got %+v", filtered)
+	}
+
+	filtered, err = filterSources(configs, nil, []string{"Home"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 1 || filtered[0].Name != "Office" {
+		t.Errorf("expected only the Office group, got %+v", filtered)
+	}
+
+	_, err = filterSources(configs, []string{"Gas"}, nil)
+	if err == nil {
+		t.Error("expected an error for an unknown source")
+	}
+}
+
+func TestBackfillProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.json")
+	months := []time.Time{testMonth, testMonth.AddDate(0, 1, 0)}
+
+	progress, err := loadBackfillProgress(path, months)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = progress.complete(path, testMonth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err = loadBackfillProgress(path, months)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !progress.isCompleted(testMonth) || progress.isCompleted(months[1]) {
+		t.Errorf("expected only the first month completed, got %v", progress.Completed)
+	}
+
+	progress, err = loadBackfillProgress(path, months[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.isCompleted(testMonth) {
+		t.Error("expected the progress of another range to be ignored")
+	}
+}
+
+func TestFindMessagePartsInlinePDF(t *testing.T) {
+	payload := &gmail.MessagePart{
+		MimeType: "multipart/related",
+		Parts: []*gmail.MessagePart{
+			{MimeType: "text/html", Body: &gmail.MessagePartBody{Data: "PHA+PC9wPg=="}},
+			{
+				MimeType: "application/pdf",
+				Headers:  []*gmail.MessagePartHeader{{Name: "Content-ID", Value: "<invoice-0324@water.example>"}},
+				Body:     &gmail.MessagePartBody{AttachmentId: "a1", Size: 100},
+			},
+		},
+	}
+
+	_, attachmentPart := findMessageParts(payload, "invoice")
+	if attachmentPart == nil {
+		t.Fatal("expected the inline pdf to be found")
+	}
+	if attachmentPart.Filename != "invoice-0324.pdf" {
+		t.Errorf("expected a name from the Content-ID, got %q", attachmentPart.Filename)
+	}
+	if payload.Parts[1].Filename != "" {
+		t.Error("expected the message part to be left unchanged")
+	}
+}
+
+func TestCheckPDFToolsMissingBinary(t *testing.T) {
+	defer func(path string) { pdftotextPath = path }(pdftotextPath)
+	pdftotextPath = filepath.Join(t.TempDir(), "pdftotext")
+
+	configs := testConfigs()
+	if err := checkPDFTools(configs); err != nil {
+		t.Errorf("expected no check for body sources, got %v", err)
+	}
+
+	configs[0].Sources[0].Location = Locations{"attachment"}
+	err := checkPDFTools(configs)
+	if err == nil || !strings.Contains(err.Error(), "install poppler-utils") {
+		t.Errorf("expected an actionable error, got %v", err)
+	}
+}
+
+func TestScrapeInvoiceGroupsExtractionGroup(t *testing.T) {
+	message := testMessage("m1", "a1")
+	message.Payload.Parts[0].Body.Data = base64.URLEncoding.EncodeToString([]byte("<p>Home: 10,00 €</p><p>Rental: 5,00 €</p>"))
+	messages := &fakeMessages{
+		messages:    map[string]*gmail.Message{"m1": message},
+		attachments: map[string]string{"a1": "%PDF-1.4"},
+	}
+
+	source := testSource()
+	source.Extractions = []Extraction{
+		{Name: "Home", StringBeforePrice: "Home:", StringAfterPrice: "€"},
+		{Name: "Rental", StringBeforePrice: "Rental:", StringAfterPrice: "€", Group: "Rental"},
+	}
+	configs := []SourceConfig{
+		{Name: "Home", Account: "personal", Sources: []Source{source}},
+		{Name: "Rental", Account: "rental"},
+	}
+	invoiceGroups := scrapeTestGroups(messages, configs, scrapeOptions{})
+
+	if len(invoiceGroups[0].Invoices) != 1 || invoiceGroups[0].Invoices[0].Value != 1000 {
+		t.Errorf("expected the Home value in the Home group, got %+v", invoiceGroups[0].Invoices)
+	}
+	if len(invoiceGroups[1].Invoices) != 1 || invoiceGroups[1].Invoices[0].Value != 500 || invoiceGroups[1].Invoices[0].FileName != "Water.pdf" {
+		t.Errorf("expected the Rental value and file in the Rental group, got %+v", invoiceGroups[1].Invoices)
+	}
+	if invoiceGroups[1].Invoices[0].Account != "personal" {
+		t.Errorf("expected the Rental value to keep the account it was scraped from, got %q", invoiceGroups[1].Invoices[0].Account)
+	}
+
+	if row := sheetRow(testMonth, invoiceGroups[0], sheetColumns(configs, 0)); !slices.Equal(row, []interface{}{"2024-03", "Home", 10.0, 10.0}) {
+		t.Errorf("expected only the Home value in its row, got %v", row)
+	}
+	if row := sheetRow(testMonth, invoiceGroups[1], sheetColumns(configs, 1)); !slices.Equal(row, []interface{}{"2024-03", "Rental", 5.0, 5.0}) {
+		t.Errorf("expected the Rental value in its row, got %v", row)
+	}
+
+	invoiceGroups[0].Invoices = nil
+	if len(sourceInvoices(configs, invoiceGroups, 0, source)) != 1 {
+		t.Error("expected the invoice saved in the Rental group to count for the source")
+	}
+}
+
+func TestExtractPriceInWords(t *testing.T) {
+	for _, test := range []struct {
+		haystack string
+		decimals int
+		expected int64
+	}{
+		{"You pay 12 euros and 34 cents.", 2, 1234},
+		{"You pay 12 euros and 5 cents.", 2, 1205},
+		{"You pay 1500 yen.", 0, 1500},
+	} {
+		value, err := extractPriceInWords(test.haystack, "pay", "en", test.decimals)
+		if err != nil {
+			t.Errorf("%q: %v", test.haystack, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("%q: expected %d, got %d", test.haystack, test.expected, value)
+		}
+	}
+
+	if _, err := extractPriceInWords("You pay 1500 yen and 5 cents.", "pay", "en", 0); err == nil {
+		t.Error("expected an error for subunits of a currency without decimals")
+	}
+}
+
+func TestStripCurrencyWords(t *testing.T) {
+	for _, amount := range []string{"12,34 euros", "12,34 â‚¬", "12,34 złotych", "12,34 руб"} {
+		if stripped := stripCurrency(amount); stripped != "12,34" {
+			t.Errorf("%q: expected 12,34, got %q", amount, stripped)
+		}
+	}
+}
+
+func TestEvaluateValueExpressionOverflow(t *testing.T) {
+	if value, err := evaluateValueExpression("(value - 100) * 2", 1234); err != nil || value != 2268 {
+		t.Errorf("expected 2268, got %d (%v)", value, err)
+	}
+
+	for _, expression := range []string{
+		"value * 10000000000000000",
+		"value + 9223372036854775807",
+		"-value - 9223372036854775807",
+	} {
+		_, err := evaluateValueExpression(expression, 1234)
+		if err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%q: expected an out of range error, got %v", expression, err)
+		}
+	}
+}
+
+func TestParseCredits(t *testing.T) {
+	format := testSource().numberFormat()
+	for _, amount := range []string{"-12,34 €", "€ -12,34", "-€12,34", "(12,34)", "€ (12,34)"} {
+		value, err := parseCents(amount, format)
+		if err != nil {
+			t.Errorf("%q: %v", amount, err)
+			continue
+		}
+		if value != -1234 {
+			t.Errorf("%q: expected -1234, got %d", amount, value)
+		}
+	}
+
+	if value, err := parseAmount("(1,234.56)", 2); err != nil || value != -123456 {
+		t.Errorf("expected -123456, got %d (%v)", value, err)
+	}
+	if _, err := parseCents("--12,34", format); err == nil {
+		t.Error("expected an error for a double minus")
+	}
+
+	if amount := formatAmount(-1234, "EUR"); amount != "-€12,34" {
+		t.Errorf("expected -€12,34, got %s", amount)
+	}
+	if amount := formatAmount(-5, "EUR"); amount != "-€0,05" {
+		t.Errorf("expected -€0,05, got %s", amount)
+	}
+}
+
+func TestThreeDecimalCurrency(t *testing.T) {
+	source := testSource()
+	source.Currency = "KWD"
+
+	value, err := parseCents("12.345", source.numberFormat())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 12345 {
+		t.Errorf("expected 12345 fils, got %d", value)
+	}
+
+	if amount := formatAmount(value, "KWD"); amount != "KWD 12,345" {
+		t.Errorf("expected KWD 12,345, got %s", amount)
+	}
+	if amount := formatAmount(1234, "JPY"); amount != "JPY 1234" {
+		t.Errorf("expected JPY 1234, got %s", amount)
+	}
+}
+
+func TestConvertAmountDecimals(t *testing.T) {
+	rates := map[string]float64{"JPY": 0.0062, "KWD": 2.98}
+
+	// ¥1000 at 0.0062 is €6,20
+	if value := convertAmount(1000, "JPY", "EUR", rates); value != 620 {
+		t.Errorf("expected 620 cents, got %d", value)
+	}
+	// KWD 12,345 at 2.98 is €36,79
+	if value := convertAmount(12345, "KWD", "EUR", rates); value != 3679 {
+		t.Errorf("expected 3679 cents, got %d", value)
+	}
+}
+
+func TestMixedCurrencyTotals(t *testing.T) {
+	invoiceGroup := InvoiceGroup{
+		Name:                      "Home",
+		HomeCurrency:              "EUR",
+		ExchangeRates:             map[string]float64{"JPY": 0.0062},
+		FolderDescriptionTemplate: "Total: {{.Total}}",
+		Invoices: []Invoice{
+			{BillName: "Water", FileName: "Water.pdf", Value: 1000},
+			{BillName: "Rail", FileName: "Rail.pdf", Value: 5000, Currency: "JPY"},
+		},
+	}
+	columns := []Source{{BillName: "Water"}, {BillName: "Rail", Currency: "JPY"}}
+
+	description, err := renderFolderDescription(invoiceGroup, testMonth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description != "Total: 41,00" {
+		t.Errorf("expected the converted total, got %q", description)
+	}
+
+	dollars := InvoiceGroup{Currency: "USD", FolderDescriptionTemplate: "Total: {{.Total}}", Invoices: []Invoice{{Value: 4100}}}
+	if description, _ := renderFolderDescription(dollars, testMonth); description != "Total: 41.00" {
+		t.Errorf("expected the total with the dollar's separator, got %q", description)
+	}
+
+	row := sheetRow(testMonth, invoiceGroup, columns)
+	if !slices.Equal(row, []interface{}{"2024-03", "Home", 10.0, 31.0, 41.0}) {
+		t.Errorf("expected converted values, got %v", row)
+	}
+}
+
+func TestSelftestValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "water.html")
+	err := os.WriteFile(path, []byte("<p>Total: 12,34 €</p>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configs := testConfigs()
+	values, err := selftestValues(configs, selftestFixture{BillName: "Water", File: "water.html"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values[0] != 1234 {
+		t.Errorf("expected [1234], got %v", values)
+	}
+
+	_, err = selftestValues(configs, selftestFixture{BillName: "Gas", File: "water.html"}, path)
+	if err == nil {
+		t.Error("expected an error for an unknown source")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Counts and values of a run, written as node_exporter textfile metrics
+type runMetrics struct {
+	// Sources scraped, once per month
+	Sources int
+
+	// Invoices saved (or already saved), failed and not found
+	Succeeded int
+	Failed    int
+	Missing   int
+
+	// Values of the invoices saved
+	Values []metricValue
+}
+
+// Extracted value of a single invoice
+type metricValue struct {
+	Month    string
+	Group    string
+	Bill     string
+	Currency string
+	Cents    int64
+}
+
+// Adds the invoices of a month, after they were saved
+func (m *runMetrics) add(month time.Time, configs []SourceConfig, invoiceGroups []InvoiceGroup) {
+	for configIdx, config := range configs {
+		m.Sources += len(config.Sources)
+
+		invoiceGroup := invoiceGroups[configIdx]
+		for _, source := range config.Sources {
+			if len(sourceInvoices(configs, invoiceGroups, configIdx, source)) == 0 {
+				m.Missing++
+			}
+		}
+
+		for _, invoice := range invoiceGroup.Invoices {
+			switch {
+			case invoice.ProcessingError != "":
+				m.Failed++
+			default:
+				m.Succeeded++
+				m.Values = append(m.Values, metricValue{
+					Month:    historyKey(month),
+					Group:    invoiceGroup.Name,
+					Bill:     invoice.BillName,
+					Currency: invoiceGroup.invoiceCurrency(invoice),
+					Cents:    invoice.Value,
+				})
+			}
+		}
+	}
+}
+
+// Escapes a Prometheus label value
+func escapeMetricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Formats the metrics in the Prometheus text exposition format
+func (m *runMetrics) format(finishedAt time.Time) string {
+	metrics := strings.Builder{}
+
+	gauge := func(name string, help string, value any) {
+		metrics.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value))
+	}
+
+	gauge("invoice_manager_sources", "Sources scraped in the last run, once per month.", m.Sources)
+	gauge("invoice_manager_invoices_succeeded", "Invoices saved in the last run.", m.Succeeded)
+	gauge("invoice_manager_invoices_failed", "Invoices that failed to be scraped or saved in the last run.", m.Failed)
+	gauge("invoice_manager_invoices_missing", "Sources without an invoice in the last run.", m.Missing)
+	gauge("invoice_manager_last_run_timestamp_seconds", "When the last run finished.", finishedAt.Unix())
+
+	metrics.WriteString("# HELP invoice_manager_invoice_value Extracted invoice value, in units of its currency.\n")
+	metrics.WriteString("# TYPE invoice_manager_invoice_value gauge\n")
+	for _, value := range m.Values {
+		metrics.WriteString(fmt.Sprintf(
+			"invoice_manager_invoice_value{month=\"%s\",group=\"%s\",bill=\"%s\",currency=\"%s\"} %s\n",
+			escapeMetricLabel(value.Month),
+			escapeMetricLabel(value.Group),
+			escapeMetricLabel(value.Bill),
+			escapeMetricLabel(value.Currency),
+			formatMinorUnits(value.Cents, minorUnits(value.Currency), "."),
+		))
+	}
+
+	return metrics.String()
+}
+
+// Writes the metrics atomically, so node_exporter never reads half a file
+func writeMetrics(path string, metrics *runMetrics, finishedAt time.Time) error {
+	return writeFileAtomic(path, []byte(metrics.format(finishedAt)), 0644)
+}
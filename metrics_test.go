@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunMetricsFormat(t *testing.T) {
+	configs := []SourceConfig{{Name: `My "Home"`, Sources: []Source{{BillName: "Water"}, {BillName: "Power"}, {BillName: "Gas"}}}}
+	invoiceGroups := []InvoiceGroup{{
+		Name: `My "Home"`,
+		Invoices: []Invoice{
+			{BillName: "Water", FileName: "Water.pdf", Value: 1234},
+			{BillName: "Power", ProcessingError: "unable to extract price"},
+		},
+	}}
+
+	metrics := runMetrics{}
+	metrics.add(testMonth, configs, invoiceGroups)
+	text := metrics.format(time.Unix(1700000000, 0))
+
+	for _, line := range []string{
+		"invoice_manager_sources 3\n",
+		"invoice_manager_invoices_succeeded 1\n",
+		"invoice_manager_invoices_failed 1\n",
+		"invoice_manager_invoices_missing 1\n",
+		"invoice_manager_last_run_timestamp_seconds 1700000000\n",
+		`invoice_manager_invoice_value{month="2024-03",group="My \"Home\"",bill="Water",currency="EUR"} 12.34` + "\n",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("expected %q in metrics:\n%s", line, text)
+		}
+	}
+}
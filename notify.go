@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// Builds the invoice summary message sent as notification, including which
+// invoices failed to be scraped or saved.
+// With attachmentInfo, each invoice also lists its original attachment name and size.
+// With messageLinks, each invoice is followed by a link to its Gmail message.
+// Invoices with a value in the history for the previous month show how much
+// they changed since, history may be nil.
+func buildNotificationMessage(invoiceGroups []InvoiceGroup, attachmentInfo bool, messageLinks bool, history History, month time.Time) string {
+	previousMonth := month.AddDate(0, -1, 0)
+
+	message := strings.Builder{}
+	for idx, invoiceGroup := range invoiceGroups {
+
+		if idx > 0 {
+			message.WriteString("\n")
+		}
+
+		message.WriteString(fmt.Sprintf("%d. %s\n", idx+1, invoiceGroup.Name))
+		for invoiceIdx, invoice := range invoiceGroup.Invoices {
+			if invoice.FileName == "" && invoice.ProcessingError != "" {
+				message.WriteString(fmt.Sprintf("+ %s - failed: %s\n", invoice.BillName, invoice.ProcessingError))
+				writeMessageLink(&message, invoice, messageLinks)
+				continue
+			}
+
+			currency := invoiceGroup.invoiceCurrency(invoice)
+
+			// The values of a source's Extractions are listed under their file
+			if invoice.Extraction != "" {
+				if invoiceIdx == 0 || invoiceGroup.Invoices[invoiceIdx-1].FileName != invoice.FileName {
+					message.WriteString(fmt.Sprintf(
+						"+ %s - %s",
+						invoice.FileName,
+						formatAmount(fileValue(invoiceGroup.Invoices, invoice.FileName), currency),
+					))
+					writeAttachmentInfo(&message, invoice, attachmentInfo)
+					message.WriteString("\n")
+					writeMessageLink(&message, invoice, messageLinks)
+				}
+				message.WriteString(fmt.Sprintf(
+					"  - %s - %s",
+					invoice.Extraction,
+					formatAmount(invoice.Value, currency),
+				))
+			} else {
+				message.WriteString(
+					fmt.Sprintf(
+						"+ %s - %s",
+						invoice.FileName,
+						formatAmount(invoice.Value, currency),
+					),
+				)
+			}
+
+			if invoice.Value < 0 {
+				message.WriteString(" (credit)")
+			}
+			if previousValue, ok := history.Lookup(previousMonth, invoiceGroup.Name, invoice.BillName); ok && invoice.ProcessingError == "" {
+				message.WriteString(fmt.Sprintf(" (%s)", formatDelta(invoice.Value, previousValue, currency)))
+			}
+			if invoice.Extraction == "" {
+				writeAttachmentInfo(&message, invoice, attachmentInfo)
+			}
+			if invoice.Warning != "" {
+				message.WriteString(fmt.Sprintf(" (warning: %s)", invoice.Warning))
+			}
+			if invoice.ProcessingError != "" {
+				message.WriteString(fmt.Sprintf(" (failed: %s)", invoice.ProcessingError))
+			}
+			message.WriteString("\n")
+			if invoice.Extraction == "" {
+				writeMessageLink(&message, invoice, messageLinks)
+			}
+		}
+		message.WriteString(fmt.Sprintf(
+			"Total: %s\n",
+			formatAmount(invoiceGroup.total(), invoiceGroup.totalCurrency()),
+		))
+	}
+
+	return message.String()
+}
+
+// Writes the original attachment name and size of an invoice, when asked to
+func writeAttachmentInfo(message *strings.Builder, invoice Invoice, attachmentInfo bool) {
+	if attachmentInfo && invoice.AttachmentName != "" {
+		message.WriteString(fmt.Sprintf(
+			" (%s, %.1f KB)",
+			invoice.AttachmentName,
+			float64(invoice.AttachmentSize)/1024,
+		))
+	}
+}
+
+// Writes a line with the link to the Gmail message of an invoice, when asked to
+func writeMessageLink(message *strings.Builder, invoice Invoice, messageLinks bool) {
+	if messageLinks && invoice.MessageId != "" {
+		message.WriteString(fmt.Sprintf("  %s\n", invoice.messageLink()))
+	}
+}
+
+// Describes the change from the previous value, like "▲ €3,10"
+func formatDelta(value int64, previousValue int64, currency string) string {
+	switch {
+	case value > previousValue:
+		return "▲ " + formatAmount(value-previousValue, currency)
+	case value < previousValue:
+		return "▼ " + formatAmount(previousValue-value, currency)
+	default:
+		return "unchanged"
+	}
+}
+
+// Writes the invoice summary message to a file, for other tools to pick up
+func writeNotificationFile(path string, message string) error {
+	return writeFileAtomic(path, []byte(message), 0644)
+}
+
+// Delivers the invoice summary message through some channel
+type Notifier interface {
+	// Short name used to select the notifier, e.g. "signal"
+	Name() string
+
+	// Delivers the message, giving up when ctx is done
+	Send(ctx context.Context, message string) error
+}
+
+// Creates the notifier with the given name, reading its settings from the
+// environment. Notifiers sending emails use the subject, the others ignore it.
+func newNotifier(name string, googleClient *http.Client, subject string) (Notifier, error) {
+	switch name {
+	case "signal":
+		return newSignalNotifier()
+	case "smtp":
+		return newSMTPNotifier(subject)
+	case "email":
+		return newEmailNotifier(googleClient, subject)
+	case "telegram":
+		return newTelegramNotifier()
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", name)
+	}
+}
+
+const (
+	notifyTimeout    = 30 * time.Second
+	notifyAttempts   = 3
+	notifyRetryDelay = 2 * time.Second
+)
+
+// Client of the notifiers calling HTTP APIs, so a hung endpoint can't block
+// the run forever
+var notifyHTTPClient = &http.Client{Timeout: notifyTimeout}
+
+// Sends a notifier API request until it gets a 200, retrying server errors
+// a couple of times. send is called again for every attempt. Waiting stops
+// when ctx is done.
+func sendNotifyRequest(ctx context.Context, send func() (*http.Response, error)) error {
+	for attempt := 1; ; attempt++ {
+		resp, err := send()
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == 200 {
+			return nil
+		}
+
+		err = fmt.Errorf("unexpected status: %v", resp.Status)
+		if resp.StatusCode < 500 || attempt == notifyAttempts {
+			return err
+		}
+
+		slog.Warn("Notifier request failed, retrying", "attempt", attempt, "attempts", notifyAttempts, "delay", notifyRetryDelay, "error", err)
+		select {
+		case <-time.After(notifyRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Sends messages through Signal using the callmebot API
+type SignalNotifier struct {
+	phoneNumber string
+	apiKey      string
+}
+
+func newSignalNotifier() (*SignalNotifier, error) {
+	phoneNumber := os.Getenv("CALLMEBOT_PHONE_NUMBER")
+	if phoneNumber == "" {
+		return nil, errors.New("CALLMEBOT_PHONE_NUMBER is not set")
+	}
+	apiKey := os.Getenv("CALLMEBOT_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("CALLMEBOT_API_KEY is not set")
+	}
+
+	return &SignalNotifier{phoneNumber: phoneNumber, apiKey: apiKey}, nil
+}
+
+func (n *SignalNotifier) Name() string {
+	return "signal"
+}
+
+func (n *SignalNotifier) Send(ctx context.Context, message string) error {
+	apiUrl := fmt.Sprintf(
+		"https://api.callmebot.com/signal/send.php?phone=%s&apikey=%s&text=",
+		n.phoneNumber,
+		n.apiKey,
+	)
+
+	err := sendNotifyRequest(ctx, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiUrl+url.QueryEscape(message), nil)
+		if err != nil {
+			return nil, err
+		}
+		return notifyHTTPClient.Do(req)
+	})
+
+	// The request URL holds the API key, keep it out of logs
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+
+	return err
+}
+
+// Sends messages through a Telegram bot
+type TelegramNotifier struct {
+	botToken string
+	chatId   string
+}
+
+func newTelegramNotifier() (*TelegramNotifier, error) {
+	botToken := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if botToken == "" {
+		return nil, errors.New("TELEGRAM_BOT_TOKEN is not set")
+	}
+	chatId := os.Getenv("TELEGRAM_CHAT_ID")
+	if chatId == "" {
+		return nil, errors.New("TELEGRAM_CHAT_ID is not set")
+	}
+
+	return &TelegramNotifier{botToken: botToken, chatId: chatId}, nil
+}
+
+func (n *TelegramNotifier) Name() string {
+	return "telegram"
+}
+
+func (n *TelegramNotifier) Send(ctx context.Context, message string) error {
+	apiUrl := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", n.botToken)
+
+	form := url.Values{
+		"chat_id": {n.chatId},
+		"text":    {message},
+	}
+
+	err := sendNotifyRequest(ctx, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiUrl, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return notifyHTTPClient.Do(req)
+	})
+
+	// The request URL holds the bot token, keep it out of logs
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+
+	return err
+}
+
+// Sends messages as a plain text email through an SMTP server
+type SMTPNotifier struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+	to       string
+	subject  string
+}
+
+func newSMTPNotifier(subject string) (*SMTPNotifier, error) {
+	n := &SMTPNotifier{
+		host:     os.Getenv("SMTP_HOST"),
+		port:     os.Getenv("SMTP_PORT"),
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     os.Getenv("SMTP_FROM"),
+		to:       os.Getenv("SMTP_TO"),
+		subject:  subject,
+	}
+
+	if n.host == "" {
+		return nil, errors.New("SMTP_HOST is not set")
+	}
+	if n.from == "" {
+		return nil, errors.New("SMTP_FROM is not set")
+	}
+	if n.to == "" {
+		return nil, errors.New("SMTP_TO is not set")
+	}
+	if n.port == "" {
+		n.port = "587"
+	}
+
+	return n, nil
+}
+
+func (n *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+// net/smtp takes no context, the send isn't cancelled with ctx
+func (n *SMTPNotifier) Send(ctx context.Context, message string) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+
+	return smtp.SendMail(
+		n.host+":"+n.port,
+		auth,
+		n.from,
+		strings.Split(n.to, ","),
+		buildEmail(n.from, n.to, n.subject, message),
+	)
+}
+
+// Sends messages as a plain text email from the authenticated Gmail account
+type EmailNotifier struct {
+	service *gmail.Service
+	to      string
+	subject string
+}
+
+func newEmailNotifier(googleClient *http.Client, subject string) (*EmailNotifier, error) {
+	to := os.Getenv("EMAIL_TO")
+	if to == "" {
+		return nil, errors.New("EMAIL_TO is not set")
+	}
+	if googleClient == nil {
+		return nil, errors.New("no authenticated google client")
+	}
+
+	service, err := gmail.NewService(context.Background(), option.WithHTTPClient(googleClient))
+	if err != nil {
+		return nil, err
+	}
+
+	return &EmailNotifier{service: service, to: to, subject: subject}, nil
+}
+
+func (n *EmailNotifier) Name() string {
+	return "email"
+}
+
+func (n *EmailNotifier) Send(ctx context.Context, message string) error {
+	// Gmail fills in the From header with the authenticated address
+	email := buildEmail("", n.to, n.subject, message)
+
+	return withRetry(ctx, func() error {
+		// Like the HTTP notifiers, a hung send gives up after notifyTimeout
+		ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		defer cancel()
+
+		_, err := n.service.Users.Messages.Send("me", &gmail.Message{
+			Raw: base64.URLEncoding.EncodeToString(email),
+		}).Context(ctx).Do()
+		return err
+	})
+}
+
+// Builds a plain text MIME email, leaving out the From header when empty
+func buildEmail(from string, to string, subject string, message string) []byte {
+	email := strings.Builder{}
+	if from != "" {
+		email.WriteString(fmt.Sprintf("From: %s\r\n", from))
+	}
+	email.WriteString(fmt.Sprintf("To: %s\r\n", to))
+	email.WriteString(fmt.Sprintf("Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject)))
+	email.WriteString("MIME-Version: 1.0\r\n")
+	email.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	email.WriteString("\r\n")
+	email.WriteString(strings.ReplaceAll(message, "\n", "\r\n"))
+
+	return []byte(email.String())
+}
+
+// Sends the invoice summary message through the given notifiers, trying
+// each in order until one succeeds. The subject is only used by email notifiers.
+func sendNotification(ctx context.Context, notifierNames []string, googleClient *http.Client, subject string, message string, dryRun bool) error {
+	// Settings may also come from the environment alone, e.g. in containers
+	godotenv.Load()
+
+	fmt.Printf("Sending notification:\n")
+
+	fmt.Println(message)
+
+	if dryRun {
+		return nil
+	}
+
+	var errs []error
+	for _, name := range notifierNames {
+		// An unconfigured notifier only falls through to the next one
+		notifier, err := newNotifier(name, googleClient, subject)
+		if err != nil {
+			slog.Warn("Unable to set up notifier", "notifier", name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		err = notifier.Send(ctx, message)
+		if err != nil {
+			slog.Warn("Notifier failed", "notifier", notifier.Name(), "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", notifier.Name(), err))
+			continue
+		}
+
+		slog.Info("Notification delivered", "notifier", notifier.Name())
+		return nil
+	}
+
+	if len(errs) == 0 {
+		return errors.New("no notifier configured")
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildNotificationMessageDelta(t *testing.T) {
+	history := History{"2024-02": {"Home": {"Water": 1000, "Power": 6000}}}
+	invoiceGroups := []InvoiceGroup{{
+		Name: "Home",
+		Invoices: []Invoice{
+			{BillName: "Water", FileName: "Water.pdf", Value: 1310},
+			{BillName: "Power", FileName: "Power.pdf", Value: 5678},
+			{BillName: "Gas", FileName: "Gas.pdf", Value: 2000},
+		},
+	}}
+
+	message := buildNotificationMessage(invoiceGroups, false, false, history, testMonth)
+
+	for _, line := range []string{
+		"+ Water.pdf - €13,10 (▲ €3,10)\n",
+		"+ Power.pdf - €56,78 (▼ €3,22)\n",
+		"+ Gas.pdf - €20,00\n",
+	} {
+		if !strings.Contains(message, line) {
+			t.Errorf("expected %q in message:\n%s", line, message)
+		}
+	}
+}
+
+func TestBuildNotificationMessageExtractions(t *testing.T) {
+	invoiceGroups := []InvoiceGroup{{
+		Name: "Home",
+		Invoices: []Invoice{
+			{BillName: "Power (Energy)", FileName: "Power.pdf", Value: 3000, Extraction: "Energy"},
+			{BillName: "Power (Standing charge)", FileName: "Power.pdf", Value: 1500, Extraction: "Standing charge"},
+		},
+	}}
+
+	message := buildNotificationMessage(invoiceGroups, false, false, History{}, testMonth)
+
+	expected := "+ Power.pdf - €45,00\n  - Energy - €30,00\n  - Standing charge - €15,00\nTotal: €45,00\n"
+	if !strings.HasSuffix(message, expected) {
+		t.Errorf("expected the values listed under the file, got:\n%s", message)
+	}
+}
+
+func TestBuildNotificationMessageHomeCurrency(t *testing.T) {
+	invoiceGroups := []InvoiceGroup{{
+		Name:          "Home",
+		HomeCurrency:  "EUR",
+		ExchangeRates: map[string]float64{"USD": 0.5},
+		Invoices: []Invoice{
+			{BillName: "Water", FileName: "Water.pdf", Value: 1000},
+			{BillName: "Streaming", FileName: "Streaming.pdf", Value: 1599, Currency: "USD"},
+		},
+	}}
+
+	message := buildNotificationMessage(invoiceGroups, false, false, History{}, testMonth)
+
+	expected := "+ Water.pdf - €10,00\n+ Streaming.pdf - $15.99\nTotal: €18,00\n"
+	if !strings.HasSuffix(message, expected) {
+		t.Errorf("expected the total in the home currency, got:\n%s", message)
+	}
+}
+
+func TestBuildNotificationMessageCredit(t *testing.T) {
+	invoiceGroups := []InvoiceGroup{{
+		Name: "Home",
+		Invoices: []Invoice{
+			{BillName: "Power", FileName: "Power.pdf", Value: 5000},
+			{BillName: "Refund", FileName: "Refund.pdf", Value: -1234},
+		},
+	}}
+
+	message := buildNotificationMessage(invoiceGroups, false, false, History{}, testMonth)
+
+	expected := "+ Power.pdf - €50,00\n+ Refund.pdf - -€12,34 (credit)\nTotal: €37,66\n"
+	if !strings.HasSuffix(message, expected) {
+		t.Errorf("expected the credit to reduce the total, got:\n%s", message)
+	}
+}
+
+func TestBuildNotificationMessageLinks(t *testing.T) {
+	invoiceGroups := []InvoiceGroup{{
+		Name: "Home",
+		Invoices: []Invoice{
+			{BillName: "Water", FileName: "Water.pdf", Value: 1310, MessageId: "m1"},
+			{BillName: "Power", ProcessingError: "price not found", MessageId: "m2"},
+		},
+	}}
+
+	message := buildNotificationMessage(invoiceGroups, false, true, History{}, testMonth)
+
+	expected := "+ Water.pdf - €13,10\n  https://mail.google.com/mail/u/0/#all/m1\n" +
+		"+ Power - failed: price not found\n  https://mail.google.com/mail/u/0/#all/m2\n"
+	if !strings.Contains(message, expected) {
+		t.Errorf("expected a link under each invoice, got:\n%s", message)
+	}
+}
+
+func TestRenderNotificationMessageTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.tmpl")
+	err := os.WriteFile(path, []byte(`{{.Month.Format "2006-01"}}{{range .InvoiceGroups}} {{.Name}}: {{formatAmount (total .) (currency .)}}{{end}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := loadNotificationTemplate(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	message, err := renderNotificationMessage(tmpl, testInvoiceGroups(), testMonth)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if message != "2024-03 Home: €69,12" {
+		t.Errorf("expected %q, got %q", "2024-03 Home: €69,12", message)
+	}
+}
+
+func TestNotificationStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notification.json")
+
+	err := saveNotificationState(path, []notificationState{{Month: testMonth, InvoiceGroups: testInvoiceGroups()}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	states, err := loadNotificationState(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(states) != 1 || !states[0].Month.Equal(testMonth) {
+		t.Fatalf("expected the month back, got %+v", states)
+	}
+
+	invoice := states[0].InvoiceGroups[0].Invoices[0]
+	if invoice.BillName != "Water" || invoice.Value != 1234 || invoice.FileContents != nil {
+		t.Errorf("expected the invoice without its contents, got %+v", invoice)
+	}
+
+	expected := buildNotificationMessage(testInvoiceGroups(), false, false, History{}, testMonth)
+	if message := buildNotificationMessage(states[0].InvoiceGroups, false, false, History{}, testMonth); message != expected {
+		t.Errorf("expected the same message, got:\n%s", message)
+	}
+}
+
+func TestSendNotificationDryRunWithoutCredentials(t *testing.T) {
+	t.Setenv("CALLMEBOT_PHONE_NUMBER", "")
+
+	err := sendNotification(context.Background(), []string{"signal"}, nil, "Invoices", "Total: €12,34", true)
+	if err != nil {
+		t.Errorf("expected a dry run without .env or notifier settings, got %v", err)
+	}
+}
+
+// Answers every notifier request with 200, recording the hosts called
+type fakeNotifyTransport struct {
+	hosts []string
+}
+
+func (f *fakeNotifyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.hosts = append(f.hosts, req.URL.Host)
+	return &http.Response{StatusCode: 200, Status: "200 OK", Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestSendNotificationSkipsUnconfiguredNotifier(t *testing.T) {
+	t.Setenv("TELEGRAM_BOT_TOKEN", "")
+	t.Setenv("CALLMEBOT_PHONE_NUMBER", "+351000000000")
+	t.Setenv("CALLMEBOT_API_KEY", "key")
+
+	transport := &fakeNotifyTransport{}
+	defer func(client *http.Client) { notifyHTTPClient = client }(notifyHTTPClient)
+	notifyHTTPClient = &http.Client{Transport: transport}
+
+	err := sendNotification(context.Background(), []string{"telegram", "signal"}, nil, "Invoices", "Total: €12,34", false)
+	if err != nil {
+		t.Fatalf("expected signal to deliver the notification, got %v", err)
+	}
+	if len(transport.hosts) != 1 || transport.hosts[0] != "api.callmebot.com" {
+		t.Errorf("expected one callmebot request, got %v", transport.hosts)
+	}
+}
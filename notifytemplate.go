@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Data available to the -notify-template notification template
+type notificationData struct {
+	// Scraped month
+	Month time.Time
+
+	// Invoices of every group, in configuration order
+	InvoiceGroups []InvoiceGroup
+}
+
+// Functions available to the notification template, e.g.
+// {{formatAmount (total .) (totalCurrency .)}}
+var notificationTemplateFuncs = template.FuncMap{
+	// Amount in cents like "12,34"
+	"formatCents": formatCents,
+
+	// Amount in cents with the currency symbol, like "€12,34"
+	"formatAmount": formatAmount,
+
+	// ISO 4217 currency code of a group
+	"currency": func(invoiceGroup InvoiceGroup) string {
+		return invoiceGroup.currency()
+	},
+
+	// Link to the Gmail message of an invoice, empty when unknown
+	"messageLink": func(invoice Invoice) string {
+		return invoice.messageLink()
+	},
+
+	// ISO 4217 currency code of an invoice of a group
+	"invoiceCurrency": func(invoiceGroup InvoiceGroup, invoice Invoice) string {
+		return invoiceGroup.invoiceCurrency(invoice)
+	},
+
+	// Total value in cents of the invoices of a group, in its totalCurrency
+	"total": func(invoiceGroup InvoiceGroup) int64 {
+		return invoiceGroup.total()
+	},
+
+	// ISO 4217 currency code of the total of a group, its HomeCurrency
+	// when set
+	"totalCurrency": func(invoiceGroup InvoiceGroup) string {
+		return invoiceGroup.totalCurrency()
+	},
+}
+
+// Parses the notification template file at path
+func loadNotificationTemplate(path string) (*template.Template, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return template.New(filepath.Base(path)).Funcs(notificationTemplateFuncs).Parse(string(contents))
+}
+
+// Renders the notification message of a month with a template
+func renderNotificationMessage(tmpl *template.Template, invoiceGroups []InvoiceGroup, month time.Time) (string, error) {
+	message := strings.Builder{}
+	err := tmpl.Execute(&message, notificationData{
+		Month:         month,
+		InvoiceGroups: invoiceGroups,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to render notification template: %w", err)
+	}
+
+	return message.String(), nil
+}
+
+// Builds the notification message of a month, with the template when set.
+// Returns the built-in message along with the error when the template fails.
+func notificationMessage(invoiceGroups []InvoiceGroup, month time.Time, history History, attachmentInfo bool, messageLinks bool, tmpl *template.Template) (string, error) {
+	message := buildNotificationMessage(invoiceGroups, attachmentInfo, messageLinks, history, month)
+	if tmpl == nil {
+		return message, nil
+	}
+
+	templateMessage, err := renderNotificationMessage(tmpl, invoiceGroups, month)
+	if err != nil {
+		return message, err
+	}
+	return templateMessage, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Whether an attachment is an image, by its MIME type or, for generic types
+// like application/octet-stream, by its file name extension
+func isImageAttachment(mimeType string, fileName string) bool {
+	if strings.HasPrefix(mimeType, "image/") {
+		return true
+	}
+
+	return strings.HasPrefix(mime.TypeByExtension(filepath.Ext(fileName)), "image/")
+}
+
+// Extracts the text of an image by running the OCR command, which gets the
+// image on its standard input and must write the text to its standard
+// output, e.g. "tesseract stdin stdout"
+func extractImageText(image io.Reader, command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("no OCRCommand configured for image attachments")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = image
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A single extracted invoice, as written to the -output summary file
+type summaryRow struct {
+	Month string `json:"month"`
+	Group string `json:"group"`
+	Bill  string `json:"bill"`
+	// Decimal value, e.g. "12.34"
+	Value string `json:"value"`
+	// Gmail message the invoice was scraped from, and a link to open it
+	MessageId   string `json:"message_id"`
+	MessageLink string `json:"message_link"`
+}
+
+// Returns one row per invoice whose value was extracted
+func summaryRows(month time.Time, invoiceGroups []InvoiceGroup) []summaryRow {
+	var rows []summaryRow
+
+	for _, invoiceGroup := range invoiceGroups {
+		for _, invoice := range invoiceGroup.Invoices {
+			if invoice.FileName == "" {
+				continue
+			}
+
+			rows = append(rows, summaryRow{
+				Month: historyKey(month),
+				Group: invoiceGroup.Name,
+				Bill:  invoice.BillName,
+				Value: formatMinorUnits(invoice.Value, minorUnits(invoiceGroup.invoiceCurrency(invoice)), "."),
+
+				MessageId:   invoice.MessageId,
+				MessageLink: invoice.messageLink(),
+			})
+		}
+	}
+
+	return rows
+}
+
+// Writes the rows as JSON when the path ends in .json, CSV otherwise
+func writeSummary(path string, rows []summaryRow) error {
+	var data []byte
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		var err error
+		data, err = json.MarshalIndent(rows, "", "    ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	default:
+		buffer := bytes.Buffer{}
+		w := csv.NewWriter(&buffer)
+		w.Write([]string{"month", "group", "bill", "value", "message_id", "message_link"})
+		for _, row := range rows {
+			w.Write([]string{row.Month, row.Group, row.Bill, row.Value, row.MessageId, row.MessageLink})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		data = buffer.Bytes()
+	}
+
+	return writeFileAtomic(path, data, 0644)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/ledongthuc/pdf"
+)
+
+// PDF text extraction backend, "pdftotext" or "go", set by -pdf-backend
+var pdfBackend = "pdftotext"
+
+// pdftotext binary, looked up in PATH unless it's a path, set by
+// -pdftotext-path
+var pdftotextPath = "pdftotext"
+
+// Returns the pdfseparate binary, from the same directory as pdftotextPath
+// when it's a path, as both come with poppler-utils
+func pdfseparatePath() string {
+	if !strings.ContainsRune(pdftotextPath, filepath.Separator) {
+		return "pdfseparate"
+	}
+	return filepath.Join(filepath.Dir(pdftotextPath), "pdfseparate")
+}
+
+// Checks that pdftotext can be run when a source reads its price from an
+// attachment, so a missing binary fails the run up front with how to fix
+// it, instead of failing every pdf
+func checkPDFTools(configs []SourceConfig) error {
+	if pdfBackend == "go" {
+		return nil
+	}
+
+	needed := false
+	for _, config := range configs {
+		for _, source := range config.Sources {
+			needed = needed || slices.Contains(source.Location, "attachment") || source.SplitByPage
+		}
+	}
+	if !needed {
+		return nil
+	}
+
+	_, err := exec.LookPath(pdftotextPath)
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s not found; install poppler-utils, point -pdftotext-path to it or set -pdf-backend=go", pdftotextPath)
+	}
+	return err
+}
+
+// Extracts the content of a pdf page and returns it as a string, with the
+// configured backend. The go backend falls back to pdftotext on pdfs it
+// can't read. Encrypted pdfs are opened with password, empty for
+// unprotected ones. The layout mode only applies to pdftotext.
+func extractPDFPageContent(source io.Reader, pageNum int, password string, layout string) (string, error) {
+	if pdfBackend != "go" {
+		return pdftotextPageContent(source, pageNum, password, layout)
+	}
+
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return "", err
+	}
+
+	pages, err := goPDFPages(data, pageNum, pageNum, password)
+	if err != nil {
+		slog.Debug("Go pdf backend failed, falling back to pdftotext", "error", err)
+		return pdftotextPageContent(bytes.NewReader(data), pageNum, password, layout)
+	}
+
+	slog.Debug("Extracted pdf text with the go backend")
+	return pages[0], nil
+}
+
+// Extracts the content of each pdf page in the range [first, last] with
+// the configured backend, like extractPDFPageContent.
+func extractPDFPages(source io.Reader, first int, last int, password string, layout string) ([]string, error) {
+	if pdfBackend != "go" {
+		return pdftotextPages(source, first, last, password, layout)
+	}
+
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := goPDFPages(data, first, last, password)
+	if err != nil {
+		slog.Debug("Go pdf backend failed, falling back to pdftotext", "error", err)
+		return pdftotextPages(bytes.NewReader(data), first, last, password, layout)
+	}
+
+	slog.Debug("Extracted pdf text with the go backend")
+	return pages, nil
+}
+
+// Extracts the plain text of the pages in [first, last] (0 meaning up to
+// the end) with a pure Go pdf library. Fails when no page has any text,
+// which usually means the library couldn't decode the pdf fonts.
+func goPDFPages(data []byte, first int, last int, password string) (pages []string, err error) {
+	// The library panics on some malformed pdfs
+	defer func() {
+		if r := recover(); r != nil {
+			pages, err = nil, fmt.Errorf("unable to read pdf: %v", r)
+		}
+	}()
+
+	// The library asks for passwords until it gets an empty one
+	passwords := []string{password}
+	reader, err := pdf.NewReaderEncrypted(bytes.NewReader(data), int64(len(data)), func() string {
+		if len(passwords) == 0 {
+			return ""
+		}
+		next := passwords[0]
+		passwords = passwords[1:]
+		return next
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	numPages := reader.NumPage()
+	if last == 0 || last > numPages {
+		last = numPages
+	}
+	if first > last {
+		return nil, fmt.Errorf("pdf has no page %d", first)
+	}
+
+	hasText := false
+	for num := first; num <= last; num++ {
+		text, err := reader.Page(num).GetPlainText(nil)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(text) != "" {
+			hasText = true
+		}
+		pages = append(pages, text)
+	}
+
+	if !hasText {
+		return nil, errors.New("no text found")
+	}
+
+	return pages, nil
+}
+
+// Returns the password of the source's encrypted pdfs, read from the
+// environment variable PDFPasswordEnv names. Empty for unprotected pdfs.
+func (s Source) pdfPassword() (string, error) {
+	if s.PDFPasswordEnv == "" {
+		return "", nil
+	}
+
+	// Secrets may live in .env alongside the notification ones
+	godotenv.Load()
+
+	password := os.Getenv(s.PDFPasswordEnv)
+	if password == "" {
+		return "", fmt.Errorf("%s is not set", s.PDFPasswordEnv)
+	}
+
+	return password, nil
+}
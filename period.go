@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Compiles a BillingPeriodRegex, which must have the `year` and `month`
+// named capture groups
+func compileBillingPeriodRegex(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if re.SubexpIndex("year") < 0 || re.SubexpIndex("month") < 0 {
+		return nil, errors.New("missing the named capture groups `year` and `month`")
+	}
+
+	return re, nil
+}
+
+// Finds the month the invoice text bills with the source's
+// BillingPeriodRegex. Returns the zero time when there's no regex or it
+// doesn't match, so the invoice stays in the scraped month.
+func (s Source) billingPeriod(invoiceText string) time.Time {
+	if s.BillingPeriodRegex == "" {
+		return time.Time{}
+	}
+
+	re, err := compileBillingPeriodRegex(s.BillingPeriodRegex)
+	if err != nil {
+		return time.Time{}
+	}
+
+	match := re.FindStringSubmatch(invoiceText)
+	if match == nil {
+		slog.Debug("Billing period not found", "bill", s.BillName)
+		return time.Time{}
+	}
+
+	year, err := strconv.Atoi(match[re.SubexpIndex("year")])
+	if err != nil {
+		return time.Time{}
+	}
+	month, err := strconv.Atoi(match[re.SubexpIndex("month")])
+	if err != nil || month < 1 || month > 12 {
+		return time.Time{}
+	}
+
+	// Two digit years are in this century
+	if year < 100 {
+		year += 2000
+	}
+
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Month of the folder an invoice is saved in: its billing period when
+// known, the scraped month otherwise
+func (i Invoice) folderMonth(month time.Time) time.Time {
+	if i.BillingPeriod.IsZero() {
+		return month
+	}
+	return i.BillingPeriod
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"time"
+)
+
+// Months of a -from/-to backfill completed without failures, so running it
+// again resumes from the first incomplete one
+type backfillProgress struct {
+	// First and last month of the backfill, like "2024-01..2024-12".
+	// Progress recorded for another range is ignored.
+	Range string
+
+	// Completed months, like "2024-03"
+	Completed []string
+}
+
+// Returns the key of a backfill's months, see backfillProgress.Range
+func backfillRange(months []time.Time) string {
+	if len(months) == 0 {
+		return ""
+	}
+	return historyKey(months[0]) + ".." + historyKey(months[len(months)-1])
+}
+
+// Reads the progress of the backfill of months, empty when the file doesn't
+// exist or is of another range
+func loadBackfillProgress(path string, months []time.Time) (backfillProgress, error) {
+	progress := backfillProgress{Range: backfillRange(months)}
+
+	progressBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return progress, nil
+	}
+	if err != nil {
+		return progress, err
+	}
+
+	var saved backfillProgress
+	err = json.Unmarshal(progressBytes, &saved)
+	if err != nil {
+		return progress, err
+	}
+	if saved.Range != progress.Range {
+		return progress, nil
+	}
+
+	return saved, nil
+}
+
+// Whether a month was already completed
+func (p backfillProgress) isCompleted(month time.Time) bool {
+	return slices.Contains(p.Completed, historyKey(month))
+}
+
+// Records a month as completed and saves the progress
+func (p *backfillProgress) complete(path string, month time.Time) error {
+	p.Completed = append(p.Completed, historyKey(month))
+
+	progressBytes, err := json.MarshalIndent(p, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, progressBytes, 0644)
+}
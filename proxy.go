@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2"
+)
+
+// Transport of the requests to the Google and notifier APIs, which honors
+// the HTTPS_PROXY and HTTP_PROXY environment variables unless -proxy is set
+var baseTransport http.RoundTripper = http.DefaultTransport
+
+// Routes the requests to the Google and notifier APIs through the proxy at
+// proxyURL, e.g. "http://proxy.example:3128". Empty keeps the proxy of the
+// environment, if any.
+func setupProxy(proxyURL string) error {
+	if proxyURL == "" {
+		return nil
+	}
+
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return err
+	}
+	if proxy.Scheme == "" || proxy.Host == "" {
+		return fmt.Errorf("%q is not a proxy url like http://host:port", proxyURL)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxy)
+
+	baseTransport = transport
+	notifyHTTPClient.Transport = transport
+	return nil
+}
+
+// Context making the oauth2 package send its requests, token refreshes
+// included, through baseTransport
+func oauth2Context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: baseTransport})
+}
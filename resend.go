@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"text/template"
+	"time"
+)
+
+// The invoices a notification was built from, as kept in the -notify-state
+// file so the notification can be sent again with the notify command
+type notificationState struct {
+	Month         time.Time      `json:"month"`
+	InvoiceGroups []InvoiceGroup `json:"invoiceGroups"`
+}
+
+// Writes the invoices of every month notified about in the run atomically
+func saveNotificationState(path string, states []notificationState) error {
+	stateBytes, err := json.MarshalIndent(states, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, stateBytes, 0644)
+}
+
+// Reads the invoices of the months notified about in the last run
+func loadNotificationState(path string) ([]notificationState, error) {
+	stateBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []notificationState
+	err = json.Unmarshal(stateBytes, &states)
+	if err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
+
+// Sends the notification of every month of the last run again, from the
+// -notify-state file, without scraping or saving anything
+func resendNotifications(options Options) error {
+	if options.NotifyStatePath == "" {
+		return errors.New("set -notify-state to the file the notifications were kept in")
+	}
+
+	states, err := loadNotificationState(options.NotifyStatePath)
+	if err != nil {
+		return fmt.Errorf("unable to read notification state: %w", err)
+	}
+
+	history, err := loadHistory(options.HistoryPath)
+	if err != nil {
+		return fmt.Errorf("unable to read history file: %w", err)
+	}
+
+	var notifyTemplate *template.Template
+	if options.NotifyTemplate != "" {
+		notifyTemplate, err = loadNotificationTemplate(options.NotifyTemplate)
+		if err != nil {
+			return fmt.Errorf("unable to read notification template: %w", err)
+		}
+	}
+
+	// Only the email notifier needs the google account
+	var googleClient *http.Client
+	if slices.Contains(options.Notifiers, "email") {
+		googleClient = loadAuthenticatedGoogleClient(options.CredentialsPath, options.TokenPath)
+	}
+
+	for _, state := range states {
+		message, err := notificationMessage(state.InvoiceGroups, state.Month, history, options.AttachmentInfo, options.MessageLinks, notifyTemplate)
+		if err != nil {
+			slog.Error("Unable to render notification template, sending the default message", "error", err)
+		}
+
+		err = sendNotification(
+			context.Background(),
+			options.Notifiers,
+			googleClient,
+			fmt.Sprintf("Invoices for %s", historyKey(state.Month)),
+			message,
+			options.DryRun,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to send notification for %s: %w", historyKey(state.Month), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	retryAttempts     = 5
+	retryInitialDelay = time.Second
+	retryMaxDelay     = 30 * time.Second
+)
+
+// Calls fn until it succeeds, fails with a non transient error or runs out
+// of attempts, waiting exponentially longer between attempts (or as long
+// as the API asks with Retry-After). Waiting stops when ctx is done.
+func withRetry(ctx context.Context, fn func() error) error {
+	delay := retryInitialDelay
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retryAttempts || !isTransientError(err) {
+			return err
+		}
+
+		wait := delay
+		if retryAfter, ok := retryAfterDelay(err); ok {
+			wait = retryAfter
+		}
+		wait = min(wait, retryMaxDelay)
+
+		slog.Warn("Transient API error, retrying", "attempt", attempt, "attempts", retryAttempts, "delay", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+// Whether a google or S3 API error is worth retrying: rate limits and
+// server failures that usually go away on their own
+func isTransientError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		// S3 response errors only tell their status code
+		var responseErr interface{ HTTPStatusCode() int }
+		if !errors.As(err, &responseErr) {
+			return false
+		}
+
+		switch responseErr.HTTPStatusCode() {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+			return true
+		}
+		return false
+	}
+
+	switch apiErr.Code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	case http.StatusForbidden:
+		// Drive reports rate limits as 403
+		for _, item := range apiErr.Errors {
+			if strings.Contains(strings.ToLower(item.Reason), "ratelimit") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the delay requested by the Retry-After header of an API error, if any
+func retryAfterDelay(err error) (time.Duration, bool) {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Header == nil {
+		return 0, false
+	}
+
+	retryAfter := apiErr.Header.Get("Retry-After")
+	if retryAfter == "" {
+		return 0, false
+	}
+
+	seconds, err := strconv.Atoi(retryAfter)
+	if err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(retryAfter)
+	if err == nil {
+		return max(time.Until(date), 0), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Environment variables holding the contents of the configuration, client
+// secret and token files, for environments where writing them to disk is
+// awkward, e.g. CI secrets or containers. The files take precedence.
+const (
+	configEnv      = "EIM_CONFIG"
+	credentialsEnv = "EIM_CREDENTIALS"
+	tokenEnv       = "EIM_TOKEN"
+)
+
+// Reads the file at path or, when it doesn't exist, the contents of the
+// environment variable env. Returns an fs.ErrNotExist error when neither
+// is set.
+func readFileOrEnv(path string, env string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return data, err
+	}
+
+	if value, ok := os.LookupEnv(env); ok && strings.TrimSpace(value) != "" {
+		return []byte(value), nil
+	}
+
+	return nil, err
+}
+
+// Returns the environment variable holding the token of a Gmail account:
+// EIM_TOKEN for the default account, or EIM_TOKEN_ followed by the account
+// name in uppercase otherwise, with every character other than letters and
+// digits replaced by "_". E.g. "work" reads EIM_TOKEN_WORK.
+func accountTokenEnv(account string) string {
+	if account == "" {
+		return tokenEnv
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, account)
+
+	return tokenEnv + "_" + name
+}
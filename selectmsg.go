@@ -0,0 +1,95 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Strategies choosing which of the messages matching a source is used
+const (
+	// The newest message, the default
+	selectFirst = "first"
+
+	// The oldest message, e.g. when reminders follow the invoice
+	selectLast = "last"
+
+	// The message with the largest attachment
+	selectLargestAttachment = "largest-attachment"
+
+	// The newest message with a pdf attachment
+	selectHasPDF = "has-pdf"
+)
+
+// Whether an attachment is a pdf, by its MIME type or file name extension
+func isPDFAttachment(attachmentPart *gmail.MessagePart) bool {
+	return attachmentPart.MimeType == "application/pdf" ||
+		strings.EqualFold(filepath.Ext(attachmentPart.Filename), ".pdf")
+}
+
+// Orders the messages found for a source, newest first as Gmail lists them,
+// in the order its SelectStrategy tries them in. Messages are fetched in
+// full only when the strategy needs their attachments, otherwise they're
+// left as listed and fetched while scraping.
+func orderMessages(ctx context.Context, messages messageLister, msgs []*gmail.Message, source Source) ([]*gmail.Message, error) {
+	switch source.SelectStrategy {
+	case "", selectFirst:
+		return msgs, nil
+	case selectLast:
+		ordered := slices.Clone(msgs)
+		slices.Reverse(ordered)
+		return ordered, nil
+	case selectLargestAttachment, selectHasPDF:
+	default:
+		return nil, fmt.Errorf("unknown SelectStrategy %q", source.SelectStrategy)
+	}
+
+	var fetched []*gmail.Message
+	for _, m := range msgs {
+		msg, err := getMessage(ctx, messages, m.Id)
+		if err != nil {
+			return nil, err
+		}
+		fetched = append(fetched, msg)
+	}
+
+	attachmentSize := func(msg *gmail.Message) int64 {
+		_, attachmentPart := findMessageParts(msg.Payload, source.AttachmentNameContains)
+		if attachmentPart == nil || attachmentPart.Body == nil {
+			return -1
+		}
+		if source.SelectStrategy == selectHasPDF && !isPDFAttachment(attachmentPart) {
+			return -1
+		}
+		return attachmentPart.Body.Size
+	}
+
+	if source.SelectStrategy == selectHasPDF {
+		return slices.DeleteFunc(fetched, func(msg *gmail.Message) bool {
+			return attachmentSize(msg) < 0
+		}), nil
+	}
+
+	slices.SortStableFunc(fetched, func(a *gmail.Message, b *gmail.Message) int {
+		return cmp.Compare(attachmentSize(b), attachmentSize(a))
+	})
+	return fetched, nil
+}
+
+// Fetches a message with its full payload
+func getMessage(ctx context.Context, messages messageLister, id string) (*gmail.Message, error) {
+	var msg *gmail.Message
+	err := withRetry(ctx, func() (err error) {
+		msg, err = messages.GetMessage(ctx, id)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve message: %w", err)
+	}
+	return msg, nil
+}
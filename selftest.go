@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// A sample invoice of a source and the values expected from it, listed in
+// the manifest of the selftest command
+type selftestFixture struct {
+	// Group of the source, only needed when several groups have a source
+	// with the same BillName
+	Group string
+
+	// Source the sample is of
+	BillName string
+
+	// Sample file, relative to the manifest: an html or text body (.html,
+	// .htm or .txt), or a pdf or image attachment
+	File string
+
+	// Expected values in minor units (cents for most currencies), one per
+	// Extraction of the source or a single one
+	Values []int64
+}
+
+// Runs every fixture of the manifest at path through the same text and
+// price extraction as real emails, without Gmail, Drive or notifiers.
+// Prints the result of each and fails when any value differs.
+func runSelftest(options Options, manifestPath string) error {
+	configs := readConfiguration(options.ConfigPath)
+	err := validateSources(configs)
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	manifestBytes, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("unable to read fixtures manifest: %w", err)
+	}
+	var fixtures []selftestFixture
+	err = json.Unmarshal(manifestBytes, &fixtures)
+	if err != nil {
+		return fmt.Errorf("unable to parse fixtures manifest: %w", err)
+	}
+
+	failed := 0
+	for _, fixture := range fixtures {
+		name := fmt.Sprintf("%s (%s)", fixture.BillName, fixture.File)
+
+		values, err := selftestValues(configs, fixture, filepath.Join(filepath.Dir(manifestPath), fixture.File))
+		switch {
+		case err != nil:
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			failed++
+		case !slices.Equal(values, fixture.Values):
+			fmt.Printf("FAIL %s: expected %v, got %v\n", name, fixture.Values, values)
+			failed++
+		default:
+			fmt.Printf("ok   %s\n", name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d fixtures failed", failed, len(fixtures))
+	}
+	return nil
+}
+
+// Extracts the values of a fixture's sample file with its source
+func selftestValues(configs []SourceConfig, fixture selftestFixture, path string) ([]int64, error) {
+	var sources []Source
+	var groupCurrency string
+	for _, config := range configs {
+		if fixture.Group != "" && config.Name != fixture.Group {
+			continue
+		}
+		for _, source := range config.Sources {
+			if source.BillName == fixture.BillName {
+				sources = append(sources, source)
+				groupCurrency = InvoiceGroup{Currency: config.Currency}.currency()
+			}
+		}
+	}
+	switch len(sources) {
+	case 0:
+		return nil, errors.New("no source with this BillName")
+	case 1:
+	default:
+		return nil, errors.New("several sources with this BillName, set the fixture's Group")
+	}
+	source := sources[0]
+	if source.Currency == "" {
+		source.Currency = groupCurrency
+	}
+
+	var location string
+	var bodyPart, attachmentPart *gmail.MessagePart
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".html", ".htm", ".txt":
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		location = "body"
+		bodyPart = &gmail.MessagePart{
+			MimeType: "text/html",
+			Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString(body)},
+		}
+		if ext == ".txt" {
+			bodyPart.MimeType = "text/plain"
+		}
+	default:
+		location = "attachment"
+		attachmentPart = &gmail.MessagePart{Filename: filepath.Base(path), MimeType: mime.TypeByExtension(ext)}
+	}
+
+	invoiceText, err := extractInvoiceText(location, source, bodyPart, attachmentPart, nil, path)
+	if err != nil {
+		return nil, err
+	}
+	invoiceText = source.normalizeText(invoiceText)
+
+	prices, err := extractPrices(invoiceText, source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract price: %w", err)
+	}
+
+	for idx, price := range prices {
+		prices[idx], _, err = applyValueRules(source, source.BillName, price)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return prices, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Addresses or domains invoice emails are sent from. Configuration files
+// can set a single sender as a plain string, e.g. "billing@acme.com".
+type Senders []string
+
+func (s *Senders) UnmarshalJSON(data []byte) error {
+	var sender string
+	if err := json.Unmarshal(data, &sender); err == nil {
+		*s = Senders{sender}
+		return nil
+	}
+
+	var senders []string
+	if err := json.Unmarshal(data, &senders); err != nil {
+		return err
+	}
+	*s = senders
+	return nil
+}
+
+func (s *Senders) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var sender string
+		if err := value.Decode(&sender); err != nil {
+			return err
+		}
+		*s = Senders{sender}
+		return nil
+	}
+
+	var senders []string
+	if err := value.Decode(&senders); err != nil {
+		return err
+	}
+	*s = senders
+	return nil
+}
+
+// Returns the Gmail search term matching any of the senders, like
+// "from:a@acme.com" or "from:(a@acme.com OR acme.com)"
+func (s Senders) query() string {
+	if len(s) == 1 {
+		return "from:" + s[0]
+	}
+	return fmt.Sprintf("from:(%s)", strings.Join(s, " OR "))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Gmail calls made while scraping invoices, so scraping can be tested
+// without a real account
+type messageLister interface {
+	// Lists one page of the messages matching the query
+	ListMessages(ctx context.Context, query string, pageToken string) (*gmail.ListMessagesResponse, error)
+
+	// Gets a message with its full payload
+	GetMessage(ctx context.Context, id string) (*gmail.Message, error)
+
+	// Gets the base64url encoded contents of a message attachment
+	GetAttachment(ctx context.Context, messageId string, attachmentId string) (*gmail.MessagePartBody, error)
+}
+
+// Messages of the authenticated user of a Gmail service
+type gmailMessages struct {
+	srv *gmail.Service
+}
+
+func (m gmailMessages) ListMessages(ctx context.Context, query string, pageToken string) (*gmail.ListMessagesResponse, error) {
+	return m.srv.Users.Messages.List("me").Q(query).PageToken(pageToken).Context(ctx).Do()
+}
+
+func (m gmailMessages) GetMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	return m.srv.Users.Messages.Get("me", id).Context(ctx).Do()
+}
+
+func (m gmailMessages) GetAttachment(ctx context.Context, messageId string, attachmentId string) (*gmail.MessagePartBody, error) {
+	return m.srv.Users.Messages.Attachments.Get("me", messageId, attachmentId).Context(ctx).Do()
+}
+
+// Drive calls made while saving invoices, so saving can be tested without
+// a real account
+type fileUploader interface {
+	// Lists the files matching the query, with the given fields
+	ListFiles(ctx context.Context, query string, fields string) ([]*drive.File, error)
+
+	// Creates a file, with the given contents unless media is nil
+	CreateFile(ctx context.Context, file *drive.File, media io.Reader) (*drive.File, error)
+
+	// Updates the metadata of a file, and its contents unless media is nil
+	UpdateFile(ctx context.Context, id string, file *drive.File, media io.Reader) (*drive.File, error)
+}
+
+// Files of a Drive service
+type driveFiles struct {
+	srv *drive.Service
+
+	// Whether files in Shared Drives are looked into too
+	sharedDrive bool
+}
+
+func (f driveFiles) ListFiles(ctx context.Context, query string, fields string) ([]*drive.File, error) {
+	call := f.srv.Files.List().Q(query).Fields(googleapi.Field(fields)).Context(ctx)
+	if f.sharedDrive {
+		call = call.SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Corpora("allDrives")
+	}
+
+	resp, err := call.Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Files, nil
+}
+
+func (f driveFiles) CreateFile(ctx context.Context, file *drive.File, media io.Reader) (*drive.File, error) {
+	call := f.srv.Files.Create(file).SupportsAllDrives(f.sharedDrive).Context(ctx)
+	if media != nil {
+		call = call.Media(media, mediaOptions(file)...)
+	}
+	return call.Do()
+}
+
+func (f driveFiles) UpdateFile(ctx context.Context, id string, file *drive.File, media io.Reader) (*drive.File, error) {
+	call := f.srv.Files.Update(id, file).SupportsAllDrives(f.sharedDrive).Context(ctx)
+	if media != nil {
+		call = call.Media(media, mediaOptions(file)...)
+	}
+	return call.Do()
+}
+
+// Uploads contents with the file's MIME type, when set, instead of sniffing it
+func mediaOptions(file *drive.File) []googleapi.MediaOption {
+	if file.MimeType == "" {
+		return nil
+	}
+	return []googleapi.MediaOption{googleapi.ContentType(file.MimeType)}
+}
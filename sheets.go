@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Appends one row per invoice group with a SheetID to its tracking
+// spreadsheet: the month, the group name, the value of each bill in
+// configuration order (empty when not found), see sheetColumns, and the
+// total.
+func appendSheetRows(ctx context.Context, client *http.Client, month time.Time, invoiceGroups []InvoiceGroup, configs []SourceConfig) error {
+	var service *sheets.Service
+
+	for configIdx, config := range configs {
+		if config.SheetID == "" {
+			continue
+		}
+
+		if service == nil {
+			var err error
+			service, err = sheets.NewService(ctx, option.WithHTTPClient(client))
+			if err != nil {
+				return fmt.Errorf("unable to retrieve Sheets client: %w", err)
+			}
+		}
+
+		row := sheetRow(month, invoiceGroups[configIdx], sheetColumns(configs, configIdx))
+
+		slog.Info("Appending totals to sheet", "group", config.Name, "sheet", config.SheetID)
+
+		err := withRetry(ctx, func() error {
+			_, err := service.Spreadsheets.Values.Append(
+				config.SheetID,
+				"A1",
+				&sheets.ValueRange{Values: [][]interface{}{row}},
+			).ValueInputOption("RAW").InsertDataOption("INSERT_ROWS").Context(ctx).Do()
+			return err
+		})
+
+		if err != nil {
+			return fmt.Errorf("unable to append to sheet of %s: %w", config.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Returns the bills with a column in the spreadsheet row of
+// configs[configIdx]: its own sources, then the extractions of other
+// groups' sources saved in it (see Extraction.Group), as sources of their
+// own bill name
+func sheetColumns(configs []SourceConfig, configIdx int) []Source {
+	columns := slices.Clone(configs[configIdx].Sources)
+	for otherIdx, config := range configs {
+		if otherIdx == configIdx {
+			continue
+		}
+		for _, source := range config.Sources {
+			for _, extraction := range source.Extractions {
+				if extraction.Group == configs[configIdx].Name {
+					columns = append(columns, Source{BillName: extractionBillName(source.BillName, extraction)})
+				}
+			}
+		}
+	}
+	return columns
+}
+
+// Builds the spreadsheet row of an invoice group, with the values of the
+// invoices of each column's bill and the group's total, in the major unit
+// of its total currency and converted like the total
+func sheetRow(month time.Time, invoiceGroup InvoiceGroup, columns []Source) []interface{} {
+	row := []interface{}{historyKey(month), invoiceGroup.Name}
+	currency := invoiceGroup.totalCurrency()
+
+	for _, source := range columns {
+		// The pages of a split pdf add up to the source's value
+		var value int64
+		ok := false
+		for _, invoice := range invoiceGroup.Invoices {
+			if invoice.FileName != "" && isSourceBill(invoice.BillName, source) {
+				value += convertAmount(invoice.Value, invoiceGroup.invoiceCurrency(invoice), currency, invoiceGroup.ExchangeRates)
+				ok = true
+			}
+		}
+		if !ok {
+			row = append(row, "")
+			continue
+		}
+
+		row = append(row, majorUnits(value, currency))
+	}
+
+	return append(row, majorUnits(invoiceGroup.total(), currency))
+}
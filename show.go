@@ -0,0 +1,92 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// Prints a table of the files archived in each group's Drive month folder
+func showArchivedInvoices(month time.Time, options Options) {
+	ctx := context.Background()
+
+	configs := readConfiguration(options.ConfigPath)
+	resolveDriveDestinations(configs)
+	err := validateDriveDestinations(configs)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	client := loadAuthenticatedGoogleClient(options.CredentialsPath, options.TokenPath)
+
+	driveService, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		log.Fatalf("Unable to retrieve Drive client: %v", err)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "GROUP\tFILE\tSIZE\tVALUE\tCURRENCY")
+
+	for _, config := range configs {
+		folderId, err := findMonthFolder(
+			ctx,
+			driveFiles{srv: driveService, sharedDrive: config.SharedDrive},
+			config.DriveDestination,
+			monthFolderName(month, config.FolderNameFormat),
+		)
+		if err != nil {
+			log.Fatalf("Unable to list files: %v", err)
+		}
+
+		if folderId == "" {
+			fmt.Fprintf(table, "%s\t-\t-\t-\t-\n", config.Name)
+			continue
+		}
+
+		call := driveService.Files.List().
+			Q(fmt.Sprintf("'%s' in parents and trashed = false", folderId)).
+			Fields("nextPageToken, files(name, size, appProperties)").
+			OrderBy("name")
+		if config.SharedDrive {
+			call = call.SupportsAllDrives(true).IncludeItemsFromAllDrives(true).Corpora("allDrives")
+		}
+
+		err = call.Pages(ctx, func(resp *drive.FileList) error {
+			for _, file := range resp.Files {
+				currency := file.AppProperties["currency"]
+				value := "-"
+				if cents, err := strconv.ParseInt(file.AppProperties["value"], 10, 64); err == nil {
+					value = formatMinorUnits(cents, minorUnits(cmp.Or(currency, defaultCurrency)), ",")
+				}
+				if currency == "" {
+					currency = "-"
+				}
+
+				fmt.Fprintf(
+					table,
+					"%s\t%s\t%.1f KB\t%s\t%s\n",
+					config.Name,
+					file.Name,
+					float64(file.Size)/1024,
+					value,
+					currency,
+				)
+			}
+			return nil
+		})
+
+		if err != nil {
+			log.Fatalf("Unable to list files: %v", err)
+		}
+	}
+
+	table.Flush()
+}
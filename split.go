@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bill name of the invoice of one page of a split pdf, e.g. "Water-p2",
+// which is the {bill} of its file name
+func pageBillName(billName string, page int) string {
+	return fmt.Sprintf("%s-p%d", billName, page)
+}
+
+// Whether an invoice bill name belongs to the source, either as its own
+// invoice, one of its Extractions or one page of it with SplitByPage
+func isSourceBill(billName string, source Source) bool {
+	if billName == source.BillName {
+		return true
+	}
+	for _, extraction := range source.Extractions {
+		if billName == extractionBillName(source.BillName, extraction) {
+			return true
+		}
+	}
+	if !source.SplitByPage {
+		return false
+	}
+
+	page, found := strings.CutPrefix(billName, source.BillName+"-p")
+	if !found {
+		return false
+	}
+	_, err := strconv.Atoi(page)
+	return err == nil
+}
+
+// Pages of a split pdf that become invoices, from the source's PageRange,
+// which defaults to every page
+func (s Source) splitPageRange() (int, int, error) {
+	if s.PageRange == "" {
+		return 1, 0, nil
+	}
+	return parsePageRange(s.PageRange)
+}
+
+// Splits the pages in [first, last] (0 meaning up to the end) of a pdf
+// into one pdf file each in dir, returning their paths in page order.
+// Uses pdfseparate cli tool, which comes with pdftotext in poppler-utils.
+func pdfseparatePages(pdfPath string, dir string, first int, last int) ([]string, error) {
+	pattern := filepath.Join(dir, "page-%d.pdf")
+
+	args := []string{"-f", strconv.Itoa(first)}
+	if last > 0 {
+		args = append(args, "-l", strconv.Itoa(last))
+	}
+	args = append(args, pdfPath, pattern)
+
+	out, err := exec.Command(pdfseparatePath(), args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	var paths []string
+	for page := first; last == 0 || page <= last; page++ {
+		path := fmt.Sprintf(pattern, page)
+		if _, err := os.Stat(path); err != nil {
+			break
+		}
+		paths = append(paths, path)
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("pdf has no page %d", first)
+	}
+
+	return paths, nil
+}
+
+// Splits a pdf attachment holding several statements into one invoice per
+// page, each with its own file and its price parsed from that page alone.
+// Pages without the source's RequireAnchor are left out, and a page whose
+// price can't be parsed fails on its own without affecting the others.
+// Page files are kept in attachmentDir when set, in memory otherwise.
+// The month and email date are used in the page file names.
+func splitInvoicePages(source Source, month time.Time, date time.Time, attachmentName string, attachmentBytes []byte, attachmentFile string, attachmentDir string) ([]Invoice, error) {
+	first, last, err := source.splitPageRange()
+	if err != nil {
+		return nil, err
+	}
+
+	pagesDir, err := os.MkdirTemp(attachmentDir, "pages-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create pages directory: %w", err)
+	}
+	if attachmentDir == "" {
+		defer os.RemoveAll(pagesDir)
+	}
+
+	// pdfseparate can't read stdin
+	pdfPath := attachmentFile
+	if pdfPath == "" {
+		pdfPath = filepath.Join(pagesDir, "attachment.pdf")
+		err = os.WriteFile(pdfPath, attachmentBytes, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("unable to write attachment: %w", err)
+		}
+	}
+
+	pagePaths, err := pdfseparatePages(pdfPath, pagesDir, first, last)
+	if err != nil {
+		return nil, fmt.Errorf("unable to split pdf: %w", err)
+	}
+
+	var invoices []Invoice
+	for idx, pagePath := range pagePaths {
+		page := first + idx
+		billName := pageBillName(source.BillName, page)
+
+		fileName := renderFileName(source.FileNameTemplate, billName, month, date, attachmentName)
+
+		invoice, skip, err := scrapePageInvoice(source, billName, fileName, pagePath, attachmentDir == "")
+		if err != nil {
+			slog.Error("Unable to process invoice page", "bill", billName, "error", err)
+			invoice = Invoice{BillName: billName, ProcessingError: err.Error()}
+		}
+		if skip {
+			slog.Debug("Anchor not found, skipping page", "bill", billName, "anchor", source.RequireAnchor)
+			continue
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
+
+// Parses the invoice of a single page file of a split pdf. Returns skip
+// when the page lacks the source's RequireAnchor.
+func scrapePageInvoice(source Source, billName string, fileName string, pagePath string, inMemory bool) (Invoice, bool, error) {
+	pageFile, err := os.Open(pagePath)
+	if err != nil {
+		return Invoice{}, false, err
+	}
+	defer pageFile.Close()
+
+	pageInfo, err := pageFile.Stat()
+	if err != nil {
+		return Invoice{}, false, err
+	}
+
+	pageText, err := extractPDFPageContent(pageFile, 1, "", source.PDFLayout)
+	if err != nil {
+		return Invoice{}, false, fmt.Errorf("unable to extract page content: %w", err)
+	}
+
+	pageText = source.normalizeText(pageText)
+	slog.Debug("Invoice text", "bill", billName, "text", pageText)
+
+	if source.RequireAnchor != "" && !strings.Contains(pageText, source.normalizeText(source.RequireAnchor)) {
+		return Invoice{}, true, nil
+	}
+
+	priceCents, err := extractPrice(pageText, source)
+	if err != nil {
+		return Invoice{}, false, fmt.Errorf("unable to extract price: %w", err)
+	}
+
+	priceCents, warning, err := applyValueRules(source, billName, priceCents)
+	if err != nil {
+		return Invoice{}, false, err
+	}
+
+	invoice := Invoice{
+		BillName:       billName,
+		Value:          priceCents,
+		FileName:       fileName,
+		AttachmentSize: int(pageInfo.Size()),
+		BillingPeriod:  source.billingPeriod(pageText),
+		Warning:        warning,
+	}
+
+	if !inMemory {
+		invoice.FilePath = pagePath
+		return invoice, false, nil
+	}
+
+	_, err = pageFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return Invoice{}, false, err
+	}
+	invoice.FileContents, err = io.ReadAll(pageFile)
+	if err != nil {
+		return Invoice{}, false, err
+	}
+
+	return invoice, false, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/joho/godotenv"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// Destination where invoices are archived, one folder per group and month
+// Failures of single invoices are recorded in their ProcessingError, the
+// returned error is reserved for failures of the whole storage.
+type Storage interface {
+	SaveInvoices(ctx context.Context, month time.Time, invoiceGroups []InvoiceGroup) error
+
+	// Whether a file of the group was already saved for the month
+	InvoiceExists(ctx context.Context, month time.Time, invoiceGroup InvoiceGroup, fileName string) (bool, error)
+}
+
+// Creates the storage backend with the given name, either "drive" or "s3".
+// With dryRun, the storage only logs what it would upload. With overwrite,
+// files that already exist are replaced instead of skipped.
+func newStorage(name string, googleClient *http.Client, dryRun bool, overwrite bool) (Storage, error) {
+	switch name {
+	case "drive":
+		return DriveStorage{client: googleClient, dryRun: dryRun, overwrite: overwrite}, nil
+	case "s3":
+		return newS3Storage(dryRun, overwrite)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", name)
+	}
+}
+
+// Default Go time layout of month folder names, e.g. "2024_3"
+const defaultFolderNameFormat = "2006_1"
+
+// Returns the name of the folder holding the invoices of a month, formatted
+// with the given Go time layout or the default one when empty
+func monthFolderName(month time.Time, format string) string {
+	if format == "" {
+		format = defaultFolderNameFormat
+	}
+	return month.Format(format)
+}
+
+// Returns the MIME type of an invoice file, pdf unless its extension says otherwise
+func invoiceContentType(fileName string) string {
+	contentType := mime.TypeByExtension(filepath.Ext(fileName))
+	if contentType == "" {
+		return "application/pdf"
+	}
+	return contentType
+}
+
+// Returns the MIME type an invoice is saved with, the one its attachment
+// was declared with unless it's missing or generic
+func (i Invoice) contentType() string {
+	if i.AttachmentType != "" && i.AttachmentType != "application/octet-stream" {
+		return i.AttachmentType
+	}
+	return invoiceContentType(i.FileName)
+}
+
+// Stores invoices in the google drive folder of each group
+type DriveStorage struct {
+	client    *http.Client
+	dryRun    bool
+	overwrite bool
+}
+
+func (s DriveStorage) SaveInvoices(ctx context.Context, month time.Time, invoiceGroups []InvoiceGroup) error {
+	return saveInvoices(ctx, s.client, month, invoiceGroups, s.dryRun, s.overwrite)
+}
+
+func (s DriveStorage) InvoiceExists(ctx context.Context, month time.Time, invoiceGroup InvoiceGroup, fileName string) (bool, error) {
+	driveService, err := drive.NewService(ctx, option.WithHTTPClient(s.client))
+	if err != nil {
+		return false, err
+	}
+
+	folderId, err := findMonthFolder(
+		ctx,
+		driveFiles{srv: driveService, sharedDrive: invoiceGroup.SharedDrive},
+		invoiceGroup.DriveDestination,
+		monthFolderName(month, invoiceGroup.FolderNameFormat),
+	)
+	if err != nil || folderId == "" {
+		return false, err
+	}
+
+	query := fmt.Sprintf(
+		"'%s' in parents and name = '%s' and trashed = false",
+		folderId,
+		fileName,
+	)
+
+	var files []*drive.File
+	err = withRetry(ctx, func() (err error) {
+		files, err = driveFiles{srv: driveService, sharedDrive: invoiceGroup.SharedDrive}.ListFiles(ctx, query, "files(id)")
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return len(files) > 0, nil
+}
+
+// Stores invoices in an Amazon S3 (or S3-compatible) bucket, under
+// "<prefix>/<group name>/<month folder>/<file name>"
+type S3Storage struct {
+	client    *s3.Client
+	bucket    string
+	prefix    string
+	dryRun    bool
+	overwrite bool
+}
+
+// Creates an S3 storage from the S3_BUCKET, S3_PREFIX and S3_ENDPOINT
+// environment variables. Credentials and region come from the standard
+// AWS chain. S3_ENDPOINT is only needed for S3-compatible services like
+// MinIO.
+func newS3Storage(dryRun bool, overwrite bool) (*S3Storage, error) {
+	// Settings may live in .env alongside the notification ones
+	godotenv.Load()
+
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("S3_BUCKET is not set")
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+
+	awsConfig, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return &S3Storage{
+		client:    client,
+		bucket:    bucket,
+		prefix:    os.Getenv("S3_PREFIX"),
+		dryRun:    dryRun,
+		overwrite: overwrite,
+	}, nil
+}
+
+// Returns the object key of an invoice file
+func (s *S3Storage) key(month time.Time, invoiceGroup InvoiceGroup, fileName string) string {
+	return path.Join(s.prefix, invoiceGroup.Name, monthFolderName(month, invoiceGroup.FolderNameFormat), fileName)
+}
+
+func (s *S3Storage) InvoiceExists(ctx context.Context, month time.Time, invoiceGroup InvoiceGroup, fileName string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(month, invoiceGroup, fileName)),
+	})
+
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (s *S3Storage) SaveInvoices(ctx context.Context, month time.Time, invoiceGroups []InvoiceGroup) error {
+
+	// Files shared by several invoices are uploaded once
+	uploaded := map[string]bool{}
+
+	for _, invoiceGroup := range invoiceGroups {
+		for invoiceIdx, invoice := range invoiceGroup.Invoices {
+			if invoice.FileName == "" || invoice.ProcessingError != "" || invoice.AlreadySaved {
+				continue
+			}
+
+			key := s.key(invoice.folderMonth(month), invoiceGroup, invoice.FileName)
+			if uploaded[key] {
+				invoiceGroup.Invoices[invoiceIdx].StorageId = key
+				continue
+			}
+
+			// Putting an object replaces any existing one
+			if !s.overwrite {
+				err := withRetry(ctx, func() error {
+					_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+						Bucket: aws.String(s.bucket),
+						Key:    aws.String(key),
+					})
+					return err
+				})
+
+				if err == nil {
+					slog.Info("File already exists", "key", key)
+					continue
+				}
+
+				var notFound *types.NotFound
+				if !errors.As(err, &notFound) {
+					invoiceGroup.Invoices[invoiceIdx].ProcessingError = fmt.Sprintf("unable to check object: %v", err)
+					continue
+				}
+			}
+
+			if s.dryRun {
+				slog.Info("Would upload file", "key", key)
+				continue
+			}
+
+			slog.Info("Uploading file", "key", key)
+
+			// Every attempt reads the file from the start
+			var openErr error
+			err := withRetry(ctx, func() error {
+				contents, err := invoice.Open()
+				if err != nil {
+					openErr = err
+					return nil
+				}
+				defer contents.Close()
+
+				_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+					Bucket:      aws.String(s.bucket),
+					Key:         aws.String(key),
+					Body:        contents,
+					ContentType: aws.String(invoice.contentType()),
+				})
+				return err
+			})
+
+			if openErr != nil {
+				invoiceGroup.Invoices[invoiceIdx].ProcessingError = fmt.Sprintf("unable to open invoice file: %v", openErr)
+				continue
+			}
+			if err != nil {
+				invoiceGroup.Invoices[invoiceIdx].ProcessingError = fmt.Sprintf("unable to upload object: %v", err)
+				continue
+			}
+
+			invoiceGroup.Invoices[invoiceIdx].StorageId = key
+			uploaded[key] = true
+		}
+	}
+
+	return nil
+}
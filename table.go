@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// Status of an invoice in the summary table
+func (i Invoice) status() string {
+	switch {
+	case i.ProcessingError != "":
+		return "failed: " + i.ProcessingError
+	case i.AlreadySaved:
+		return "already saved"
+	case i.Warning != "":
+		return "warning: " + i.Warning
+	default:
+		return "ok"
+	}
+}
+
+// Writes an aligned table of the month's invoices, with their group, bill,
+// value and status, sources without an invoice and the total of every
+// currency across all groups
+func writeInvoiceTable(w io.Writer, month time.Time, configs []SourceConfig, invoiceGroups []InvoiceGroup) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "GROUP\tBILL\tVALUE\tSTATUS\n")
+
+	totals := map[string]int64{}
+	for configIdx, config := range configs {
+		invoiceGroup := invoiceGroups[configIdx]
+		for _, invoice := range invoiceGroup.Invoices {
+			currency := invoiceGroup.invoiceCurrency(invoice)
+			value := ""
+			if invoice.ProcessingError == "" {
+				value = formatAmount(invoice.Value, currency)
+				totals[currency] += invoice.Value
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", invoiceGroup.Name, invoice.BillName, value, invoice.status())
+		}
+
+		for _, source := range config.Sources {
+			if len(sourceInvoices(configs, invoiceGroups, configIdx, source)) > 0 {
+				continue
+			}
+
+			status := "missing"
+			if billingMonth, err := source.isBillingMonth(month); err == nil && !billingMonth {
+				status = "not expected"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t\t%s\n", invoiceGroup.Name, source.BillName, status)
+		}
+	}
+
+	currencies := make([]string, 0, len(totals))
+	for currency := range totals {
+		currencies = append(currencies, currency)
+	}
+	slices.Sort(currencies)
+
+	for _, currency := range currencies {
+		fmt.Fprintf(tw, "TOTAL\t\t%s\n", formatAmount(totals[currency], currency))
+	}
+
+	return tw.Flush()
+}
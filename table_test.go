@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteInvoiceTable(t *testing.T) {
+	configs := []SourceConfig{{
+		Name:    "Home",
+		Sources: []Source{{BillName: "Water"}, {BillName: "Power"}, {BillName: "Gas"}},
+	}}
+	invoiceGroups := []InvoiceGroup{{
+		Name: "Home",
+		Invoices: []Invoice{
+			{BillName: "Water", FileName: "Water.pdf", Value: 1234},
+			{BillName: "Power", ProcessingError: "unable to extract price"},
+		},
+	}}
+
+	var out strings.Builder
+	err := writeInvoiceTable(&out, testMonth, configs, invoiceGroups)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "" +
+		"GROUP  BILL   VALUE   STATUS\n" +
+		"Home   Water  €12,34  ok\n" +
+		"Home   Power          failed: unable to extract price\n" +
+		"Home   Gas            missing\n" +
+		"TOTAL         €12,34\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Day of the month by which required invoices are expected, when the
+// source doesn't configure one
+const defaultDeadlineDay = 28
+
+// Returns the alert messages of the required sources whose invoice is still
+// missing past their deadline day
+func missingInvoiceAlerts(configs []SourceConfig, invoiceGroups []InvoiceGroup, now time.Time, month time.Time) map[string]string {
+	alerts := map[string]string{}
+
+	for configIdx, config := range configs {
+		for _, source := range config.Sources {
+			if !source.Required {
+				continue
+			}
+
+			deadlineDay := source.DeadlineDay
+			if deadlineDay == 0 {
+				deadlineDay = defaultDeadlineDay
+			}
+			if now.Day() < deadlineDay {
+				continue
+			}
+
+			billingMonth, err := source.isBillingMonth(month)
+			if err != nil || !billingMonth {
+				continue
+			}
+
+			found := slices.ContainsFunc(sourceInvoices(configs, invoiceGroups, configIdx, source), func(invoice Invoice) bool {
+				return invoice.ProcessingError == ""
+			})
+			if found {
+				continue
+			}
+
+			alert := source.MissingAlert
+			if alert == "" {
+				alert = fmt.Sprintf("%s invoice not received yet", source.BillName)
+			}
+
+			key := fmt.Sprintf("%s/%s/%s", historyKey(month), config.Name, source.BillName)
+			alerts[key] = alert
+		}
+	}
+
+	return alerts
+}
+
+// Re-checks the inbox for the current month every interval and sends an
+// alert, once per month, for each required invoice missing past its deadline
+func watchRequiredInvoices(interval time.Duration, options Options) error {
+	configs := readConfiguration(options.ConfigPath)
+	err := validateSources(configs)
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	googleClient := loadAuthenticatedGoogleClient(options.CredentialsPath, options.TokenPath)
+	accountClients := loadAccountClients(options.CredentialsPath, options.TokenPath, configs, googleClient)
+
+	alerted := map[string]bool{}
+
+	for {
+		now := time.Now()
+		month, _ := parseMonth("now")
+
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if options.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		}
+		invoiceGroups, err := scrapeEmailInvoices(ctx, accountClients, month, configs, scrapeOptions{
+			Concurrency: options.Concurrency,
+			Location:    options.Timezone,
+			CacheDir:    options.CacheDir,
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		for key, alert := range missingInvoiceAlerts(configs, invoiceGroups, now, month) {
+			if alerted[key] {
+				continue
+			}
+
+			err = sendNotification(
+				context.Background(),
+				options.Notifiers,
+				googleClient,
+				fmt.Sprintf("Missing invoice for %s", historyKey(month)),
+				alert,
+				options.DryRun,
+			)
+			if err != nil {
+				slog.Warn("Unable to send missing invoice alert", "error", err)
+				continue
+			}
+			alerted[key] = true
+		}
+
+		slog.Info("Next check", "in", interval)
+		time.Sleep(interval)
+	}
+}
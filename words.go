@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Words used to spell out an amount, e.g. "12 euros and 34 cents"
+type amountWords struct {
+	// Major currency unit, singular and plural forms
+	units []string
+
+	// Word joining the units and the subunits
+	and []string
+
+	// Minor currency unit, singular and plural forms
+	subunits []string
+}
+
+// Spelled out amount words per language
+var amountWordsByLanguage = map[string]amountWords{
+	"en": {
+		units:    []string{"euros", "euro", "dollars", "dollar", "pounds", "pound", "yen"},
+		and:      []string{"and"},
+		subunits: []string{"cents", "cent", "pence", "penny"},
+	},
+	"pt": {
+		units:    []string{"euros", "euro", "reais", "real"},
+		and:      []string{"e"},
+		subunits: []string{"cêntimos", "cêntimo", "centimos", "centimo", "centavos", "centavo"},
+	},
+	"es": {
+		units:    []string{"euros", "euro", "dólares", "dólar", "dolares", "dolar"},
+		and:      []string{"con", "y"},
+		subunits: []string{"céntimos", "céntimo", "centimos", "centimo", "centavos", "centavo"},
+	},
+}
+
+// Compiles the pattern matching "<int> <unit> [<and> <int> <subunit>]"
+func amountWordsPattern(language string) (*regexp.Regexp, error) {
+	if language == "" {
+		language = "en"
+	}
+
+	words, ok := amountWordsByLanguage[language]
+	if !ok {
+		return nil, fmt.Errorf("unsupported language %q", language)
+	}
+
+	alternatives := func(words []string) string {
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = regexp.QuoteMeta(word)
+		}
+		return strings.Join(quoted, "|")
+	}
+
+	return regexp.Compile(fmt.Sprintf(
+		`(?i)(\d+)\s*(?:%s)\b(?:\s*(?:%s)\s*(\d{1,3})\s*(?:%s)\b)?`,
+		alternatives(words.units),
+		alternatives(words.and),
+		alternatives(words.subunits),
+	))
+}
+
+// Finds and extracts a price spelled out like "12 euros and 34 cents" in
+// the `haystack`, after `firstString` when it is set, in minor units with
+// the given number of decimals (see minorUnits).
+func extractPriceInWords(haystack string, firstString string, language string, decimals int) (int64, error) {
+	pattern, err := amountWordsPattern(language)
+	if err != nil {
+		return 0, err
+	}
+
+	if firstString != "" {
+		index := strings.Index(haystack, firstString)
+		if index < 0 {
+			return 0, fmt.Errorf("%q not found", firstString)
+		}
+		haystack = haystack[index+len(firstString):]
+	}
+
+	match := pattern.FindStringSubmatch(haystack)
+	if match == nil {
+		return 0, fmt.Errorf("no amount in words found")
+	}
+
+	units, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	unit := int64(math.Pow10(decimals))
+
+	var subunits int64 = 0
+	if match[2] != "" {
+		subunits, err = strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if subunits >= unit {
+			return 0, fmt.Errorf("too many subunits in %q", match[0])
+		}
+	}
+
+	return units*unit + subunits, nil
+}